@@ -1,5 +1,11 @@
 #!/bin/sh
 
+# Use the same ACL token variables as the Consul CLI
+TOKEN="${CONSUL_HTTP_TOKEN}"
+if [ -z "${TOKEN}" ] && [ -n "${CONSUL_HTTP_TOKEN_FILE}" ]; then
+  TOKEN="$(cat "${CONSUL_HTTP_TOKEN_FILE}")"
+fi
+
 cat <<EOF > hello-client-service.json
 {
   "Name": "client"
@@ -7,5 +13,6 @@ cat <<EOF > hello-client-service.json
 EOF
 
 curl -X PUT \
+    --header "X-Consul-Token: ${TOKEN}" \
     --data @hello-client-service.json \
     "http://${HOST_IP}:8500/v1/agent/service/register"
\ No newline at end of file
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connectHostname resolves to the instances of the hello service that accept
+// Connect traffic.
+const connectHostname = "hello.connect.consul"
+
+// consulTimeout bounds requests to the agent's Connect endpoints. Blocking
+// queries are held for up to five minutes by default, leave headroom over
+// that.
+const consulTimeout = 6 * time.Minute
+
+// defaultConsulAddr resolves the Consul agent address the way the Consul CLI
+// does: CONSUL_HTTP_ADDR, with CONSUL_HTTP_SSL switching a bare or http
+// address to https. Without CONSUL_HTTP_ADDR the agent on HOST_IP is used, or
+// the local one when HOST_IP is not set either.
+// See: https://www.consul.io/docs/commands#environment-variables
+func defaultConsulAddr() string {
+	addr := os.Getenv("CONSUL_HTTP_ADDR")
+	if addr == "" {
+		host := os.Getenv("HOST_IP")
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		addr = net.JoinHostPort(host, "8500")
+	}
+	if strings.HasPrefix(addr, "unix://") {
+		return addr
+	}
+
+	ssl, _ := strconv.ParseBool(os.Getenv("CONSUL_HTTP_SSL"))
+	switch {
+	case strings.HasPrefix(addr, "http://") && ssl:
+		return "https://" + strings.TrimPrefix(addr, "http://")
+	case strings.Contains(addr, "://"):
+		return addr
+	case ssl:
+		return "https://" + addr
+	default:
+		return "http://" + addr
+	}
+}
+
+// newConsulClient returns the base URL and HTTP client for the agent at addr,
+// dialing the socket for unix:// addresses and trusting CONSUL_CACERT for
+// https ones.
+func newConsulClient(addr string) (string, *http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	client := http.Client{Transport: transport, Timeout: consulTimeout}
+
+	if strings.HasPrefix(addr, "unix://") {
+		path := strings.TrimPrefix(addr, "unix://")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		return "http://consul", &client, nil
+	}
+
+	if caFile := os.Getenv("CONSUL_CACERT"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return "", nil, fmt.Errorf("CONSUL_CACERT: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return "", nil, fmt.Errorf("CONSUL_CACERT: no certificates found in '%s'", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+	}
+	return strings.TrimSuffix(addr, "/"), &client, nil
+}
+
+// consulToken is the ACL token sent to the Consul agent, either fixed or read
+// from a file on every request so that rotated tokens are picked up.
+type consulToken struct {
+	token string
+	file  string
+}
+
+func (t consulToken) get() (string, error) {
+	if t.token != "" || t.file == "" {
+		return t.token, nil
+	}
+	body, err := ioutil.ReadFile(t.file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file '%s': %v", t.file, err)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// connectDialer builds TLS configs for calling a Connect-native service as a
+// Connect-native client. The client's leaf certificate and the CA roots are
+// fetched from the local Consul agent and kept current with blocking queries.
+// See: https://www.consul.io/docs/connect/native
+type connectDialer struct {
+	consulAddr string
+	client     *http.Client
+	token      consulToken
+	service    string
+	target     string
+
+	mu          sync.RWMutex
+	leaf        *tls.Certificate
+	roots       *x509.CertPool
+	trustDomain string
+}
+
+// newConnectDialer fetches the leaf certificate for service and the roots, and
+// keeps them current in the background.
+func newConnectDialer(consulAddr string, token consulToken, service, target string) (*connectDialer, error) {
+	base, client, err := newConsulClient(consulAddr)
+	if err != nil {
+		return nil, err
+	}
+	d := connectDialer{
+		consulAddr: base,
+		client:     client,
+		token:      token,
+		service:    service,
+		target:     target,
+	}
+
+	leafPath := "/v1/agent/connect/ca/leaf/" + url.PathEscape(service)
+	leafIndex, err := d.fetch(leafPath, 0, d.setLeaf)
+	if err != nil {
+		return nil, err
+	}
+	rootsIndex, err := d.fetch("/v1/agent/connect/ca/roots", 0, d.setRoots)
+	if err != nil {
+		return nil, err
+	}
+
+	go d.watch(leafPath, leafIndex, d.setLeaf)
+	go d.watch("/v1/agent/connect/ca/roots", rootsIndex, d.setRoots)
+	return &d, nil
+}
+
+// watch makes blocking queries against path and applies every new result.
+func (d *connectDialer) watch(path string, index uint64, apply func([]byte) error) {
+	for {
+		// Reset if it goes backwards or is 0
+		// See: https://www.consul.io/api/features/blocking.html#implementation-details
+		if index == 0 {
+			index = 1
+		}
+		next, err := d.fetch(path, index, apply)
+		if err != nil {
+			log.Printf("[ERR] connect: failed to watch '%s': %v", path, err)
+			time.Sleep(interval)
+			continue
+		}
+		if next < index {
+			index = 0
+			continue
+		}
+		index = next
+	}
+}
+
+// fetch queries path and applies the result if its index moved past index.
+func (d *connectDialer) fetch(path string, index uint64, apply func([]byte) error) (uint64, error) {
+	target := d.consulAddr + path
+	if index > 0 {
+		target += fmt.Sprintf("?index=%d", index)
+	}
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %v", err)
+	}
+	token, err := d.token.get()
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read body: %v", err)
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return 0, fmt.Errorf("failed to get '%s': permission denied by Consul ACLs: %s", target, bytes.TrimSpace(body))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to get '%s'. code: %d, resp: %s", target, resp.StatusCode, body)
+	}
+
+	var next uint64
+	fmt.Sscan(resp.Header.Get("X-Consul-Index"), &next)
+	if index == 0 || next > index {
+		if err := apply(body); err != nil {
+			return 0, err
+		}
+	}
+	return next, nil
+}
+
+func (d *connectDialer) setLeaf(body []byte) error {
+	var leaf struct {
+		CertPEM       string
+		PrivateKeyPEM string
+	}
+	if err := json.Unmarshal(body, &leaf); err != nil {
+		return fmt.Errorf("failed to decode leaf certificate: %v", err)
+	}
+	cert, err := tls.X509KeyPair([]byte(leaf.CertPEM), []byte(leaf.PrivateKeyPEM))
+	if err != nil {
+		return fmt.Errorf("failed to parse leaf certificate: %v", err)
+	}
+
+	d.mu.Lock()
+	d.leaf = &cert
+	d.mu.Unlock()
+
+	log.Printf("[INFO] connect: loaded leaf certificate for '%s'", d.service)
+	return nil
+}
+
+func (d *connectDialer) setRoots(body []byte) error {
+	var roots struct {
+		TrustDomain string
+		Roots       []struct {
+			ID       string
+			RootCert string
+		}
+	}
+	if err := json.Unmarshal(body, &roots); err != nil {
+		return fmt.Errorf("failed to decode CA roots: %v", err)
+	}
+	pool := x509.NewCertPool()
+	for _, root := range roots.Roots {
+		if !pool.AppendCertsFromPEM([]byte(root.RootCert)) {
+			return fmt.Errorf("failed to parse CA root '%s'", root.ID)
+		}
+	}
+
+	d.mu.Lock()
+	d.roots = pool
+	d.trustDomain = roots.TrustDomain
+	d.mu.Unlock()
+
+	log.Printf("[INFO] connect: loaded %d CA roots for trust domain '%s'", len(roots.Roots), roots.TrustDomain)
+	return nil
+}
+
+// tlsConfig returns a client TLS config that presents the latest leaf
+// certificate and only accepts the target service.
+func (d *connectDialer) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Connect certificates identify services by URI SAN rather than by
+		// host name, so the standard verification is replaced by verifyServer
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: d.verifyServer,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			d.mu.RLock()
+			defer d.mu.RUnlock()
+			return d.leaf, nil
+		},
+	}
+}
+
+// verifyServer checks that the server's certificate chains to the Connect CA
+// and identifies the target service in the trust domain.
+func (d *connectDialer) verifyServer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("connect: server did not present a certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("connect: failed to parse server certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+
+	d.mu.RLock()
+	roots, trustDomain := d.roots, d.trustDomain
+	d.mu.RUnlock()
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := certs[0]
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		return fmt.Errorf("connect: failed to verify server certificate: %v", err)
+	}
+
+	for _, uri := range leaf.URIs {
+		if uri.Scheme == "spiffe" && uri.Host == trustDomain && strings.HasSuffix(uri.Path, "/svc/"+d.target) {
+			return nil
+		}
+	}
+	return fmt.Errorf("connect: server certificate does not identify service '%s'", d.target)
+}
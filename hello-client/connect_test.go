@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTrustDomain = "11111111-2222-3333-4444-555555555555.consul"
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// Only log with -v
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// testCert is a certificate generated for a test, with its key.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// generateCert creates a certificate from tmpl, signed by parent or
+// self-signed when parent is nil.
+func generateCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signerCert, signerKey := tmpl, key
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, key.Public(), signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// generateCA creates a self-signed CA certificate.
+func generateCA(t *testing.T, name string) *testCert {
+	return generateCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}, nil)
+}
+
+// issueLeaf issues a Connect leaf certificate for service, signed by ca.
+func issueLeaf(t *testing.T, ca *testCert, trustDomain, service string) *testCert {
+	uri := &url.URL{Scheme: "spiffe", Host: trustDomain, Path: "/ns/default/dc/dc1/svc/" + service}
+	return generateCert(t, &x509.Certificate{
+		URIs:        []*url.URL{uri},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, ca)
+}
+
+// newFakeConnectAgent serves the Connect CA endpoints of a Consul agent,
+// issuing leaf certificates from ca. Blocking queries are held until the
+// returned function closes the agent.
+func newFakeConnectAgent(t *testing.T, ca *testCert) (*httptest.Server, func()) {
+	stop := make(chan struct{})
+	hold := func(w http.ResponseWriter, r *http.Request, index string) bool {
+		w.Header().Set("X-Consul-Index", index)
+		if r.URL.Query().Get("index") == "" {
+			return false
+		}
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+		return true
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agent/connect/ca/leaf/", func(w http.ResponseWriter, r *http.Request) {
+		if hold(w, r, "10") {
+			return
+		}
+		leaf := issueLeaf(t, ca, testTrustDomain, strings.TrimPrefix(r.URL.Path, "/v1/agent/connect/ca/leaf/"))
+		json.NewEncoder(w).Encode(map[string]string{
+			"CertPEM":       string(leaf.certPEM),
+			"PrivateKeyPEM": string(leaf.keyPEM),
+		})
+	})
+	mux.HandleFunc("/v1/agent/connect/ca/roots", func(w http.ResponseWriter, r *http.Request) {
+		if hold(w, r, "5") {
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"TrustDomain": testTrustDomain,
+			"Roots":       []map[string]string{{"ID": "root", "RootCert": string(ca.certPEM)}},
+		})
+	})
+
+	ts := httptest.NewServer(mux)
+	return ts, func() {
+		// Held queries must return before Close waits on them
+		close(stop)
+		ts.Close()
+	}
+}
+
+func TestConnectDialer(t *testing.T) {
+	ca := generateCA(t, "Consul CA")
+	ts, closeAgent := newFakeConnectAgent(t, ca)
+	defer closeAgent()
+	d, err := newConnectDialer(ts.URL, consulToken{}, "web", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		server *testCert
+		ok     bool
+	}{
+		{"target service", issueLeaf(t, ca, testTrustDomain, "hello"), true},
+		{"wrong service", issueLeaf(t, ca, testTrustDomain, "db"), false},
+		{"service with target as suffix", issueLeaf(t, ca, testTrustDomain, "not-hello"), false},
+		{"wrong trust domain", issueLeaf(t, ca, "other.consul", "hello"), false},
+		{"other CA", issueLeaf(t, generateCA(t, "Other CA"), testTrustDomain, "hello"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := d.verifyServer([][]byte{tt.server.cert.Raw}, nil)
+			if ok := err == nil; ok != tt.ok {
+				t.Errorf("verifyServer: got error %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+
+	// A full handshake presents the client's leaf to a Connect server
+	server, err := tls.X509KeyPair(tests[0].server.certPEM, tests[0].server.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	srv := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	handshake := make(chan error, 1)
+	go func() { handshake <- srv.Handshake() }()
+
+	if err := tls.Client(clientConn, d.tlsConfig()).Handshake(); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	if err := <-handshake; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+	peer := srv.ConnectionState().PeerCertificates[0]
+	if got := peer.URIs[0].String(); !strings.HasSuffix(got, "/svc/web") {
+		t.Errorf("client certificate identifies %s, want service web", got)
+	}
+}
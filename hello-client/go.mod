@@ -1,5 +1,15 @@
 module github.com/freddygv/consul-getting-started/hello-client
 
-go 1.12
+go 1.21
 
-require github.com/miekg/dns v1.1.16
+require (
+	github.com/golang/protobuf v1.3.2
+	google.golang.org/grpc v1.23.0
+)
+
+require (
+	golang.org/x/net v0.0.0-20190311183353-d8887717615a // indirect
+	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a // indirect
+	golang.org/x/text v0.3.0 // indirect
+	google.golang.org/genproto v0.0.0-20180817151627-c66870c02cf8 // indirect
+)
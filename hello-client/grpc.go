@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	hellov1 "github.com/freddygv/consul-getting-started/hello-client/proto/hello/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// grpcPort is the port of the hello service's gRPC server.
+const grpcPort = "9090"
+
+// dialGreeter connects to the Greeter service on the first address Consul
+// returns for name, over TLS when tlsConfig is set.
+func dialGreeter(ctx context.Context, name string, tlsConfig *tls.Config) (*grpc.ClientConn, string, error) {
+	ips, err := net.LookupIP(name)
+	if err != nil || len(ips) == 0 {
+		return nil, "", fmt.Errorf("could not find IP for '%s': %v", name, err)
+	}
+
+	// Use first result since they are shuffled by Consul
+	target := net.JoinHostPort(ips[0].String(), grpcPort)
+	creds := grpc.WithInsecure()
+	if tlsConfig != nil {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	conn, err := grpc.DialContext(ctx, target, creds, grpc.WithBlock())
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to dial '%s': %v", target, err)
+	}
+	return conn, target, nil
+}
+
+// sayHello calls SayHello once.
+func sayHello(name string, tlsConfig *tls.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), interval)
+	defer cancel()
+
+	conn, target, err := dialGreeter(ctx, name, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := hellov1.NewGreeterClient(conn).SayHello(ctx, &hellov1.SayHelloRequest{})
+	if err != nil {
+		return err
+	}
+	log.Printf("%s says: %s (%s)", target, resp.Greeting, resp.Language)
+	return nil
+}
+
+// watchGreeting logs every greeting sent by WatchGreeting until the stream
+// ends.
+func watchGreeting(name string, tlsConfig *tls.Config) error {
+	dialCtx, cancel := context.WithTimeout(context.Background(), interval)
+	conn, target, err := dialGreeter(dialCtx, name, tlsConfig)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stream, err := hellov1.NewGreeterClient(conn).WatchGreeting(context.Background(), &hellov1.WatchGreetingRequest{})
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] watching greeting of %s", target)
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return fmt.Errorf("%s closed the greeting stream", target)
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("%s says: %s (%s)", target, resp.Greeting, resp.Language)
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"time"
 )
 
@@ -19,13 +22,55 @@ const (
 
 func main() {
 	var (
-		loop      = flag.Bool("loop", true, "Make continuous requests to hello service.")
+		loop       = flag.Bool("loop", true, "Make continuous requests to hello service.")
+		useGRPC    = flag.Bool("grpc", false, "Call the hello service's Greeter over gRPC instead of HTTP.")
+		watch      = flag.Bool("watch", false, "With -grpc, stream greeting changes with WatchGreeting instead of calling SayHello.")
+		caFile     = flag.String("ca-file", "", "CA certificates to verify the hello service with. Enables HTTPS.")
+		certFile   = flag.String("cert-file", "", "Client certificate to present to the hello service.")
+		keyFile    = flag.String("key-file", "", "Private key of the client certificate.")
+		serverName = flag.String("server-name", hostname, "Name the hello service certificate must be valid for.")
+		connectSvc = flag.String("connect-service", "", "Call the hello service as this Connect-native service using certificates from the Consul agent.")
+		consulAddr = flag.String("consul-addr", defaultConsulAddr(), "Consul agent address used with -connect-service. Defaults to CONSUL_HTTP_ADDR.")
+		token      = flag.String("consul-token", os.Getenv("CONSUL_HTTP_TOKEN"), "ACL token for Consul requests.")
+		tokenFile  = flag.String("consul-token-file", os.Getenv("CONSUL_HTTP_TOKEN_FILE"), "File holding the ACL token for Consul requests, read on every request.")
 	)
 	flag.Parse()
 
+	if *watch && !*useGRPC {
+		log.Fatalf("[ERR] -watch requires -grpc")
+	}
+
+	var tlsConfig *tls.Config
+	client, scheme, name := http.DefaultClient, "http", hostname
+	if *connectSvc != "" {
+		dialer, err := newConnectDialer(*consulAddr, consulToken{token: *token, file: *tokenFile}, *connectSvc, "hello")
+		if err != nil {
+			log.Fatalf("[ERR] connect: %v", err)
+		}
+		tlsConfig, name = dialer.tlsConfig(), connectHostname
+	} else if *caFile != "" {
+		var err error
+		if tlsConfig, err = newTLSConfig(*caFile, *certFile, *keyFile, *serverName); err != nil {
+			log.Fatalf("[ERR] %v", err)
+		}
+	}
+	if tlsConfig != nil {
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		scheme = "https"
+	}
+
 	ticker := time.NewTicker(interval)
 	for {
-		if err := requestHello(); err != nil {
+		var err error
+		switch {
+		case *watch:
+			err = watchGreeting(name, tlsConfig)
+		case *useGRPC:
+			err = sayHello(name, tlsConfig)
+		default:
+			err = requestHello(client, scheme, name)
+		}
+		if err != nil {
 			log.Printf("[ERR] failed to dial hello service: %v", err)
 		}
 		if !*loop {
@@ -36,18 +81,48 @@ func main() {
 	}
 }
 
-func requestHello() error {
-	ips, err := net.LookupIP(hostname)
+// newTLSConfig returns a TLS config that verifies the hello service against
+// the CAs in caFile and serverName, and presents the client certificate if
+// one is given.
+func newTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file '%s': %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file '%s'", caFile)
+	}
+
+	cfg := tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+		// Requests are sent to the IP Consul returned, so the certificate is
+		// checked against the service name instead
+		ServerName: serverName,
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key pair from '%s' and '%s': %v", certFile, keyFile, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return &cfg, nil
+}
+
+func requestHello(client *http.Client, scheme, name string) error {
+	ips, err := net.LookupIP(name)
 	if err != nil || len(ips) == 0 {
-		return fmt.Errorf("could not find IP for '%s': %v", hostname, err)
+		return fmt.Errorf("could not find IP for '%s': %v", name, err)
 	}
 
 	// Use first result since they are shuffled by Consul
 	addr := ips[0].String()
 
 	// Use result to query Hello service
-	target := fmt.Sprintf("http://%s/%s", net.JoinHostPort(addr, hostPort), endpoint)
-	resp, err := http.Get(target)
+	target := fmt.Sprintf("%s://%s/%s", scheme, net.JoinHostPort(addr, hostPort), endpoint)
+	resp, err := client.Get(target)
 	if err != nil {
 		return err
 	}
@@ -60,4 +135,4 @@ func requestHello() error {
 
 	log.Println(fmt.Sprintf("%s says: %s", target, body))
 	return nil
-}
\ No newline at end of file
+}
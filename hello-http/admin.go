@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// maxBodySize limits the size of request bodies accepted by admin endpoints.
+const maxBodySize = 1 << 20
+
+// handleGetConfig returns the effective config.
+func (s *server) handleGetConfig() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.config())
+	}
+}
+
+// handlePatchConfig applies a partial config to the runtime layer. Fields
+// that are missing in the body are left unchanged, and null fields lose their
+// runtime value, falling back to the lower layers. Fields only read at
+// startup are refused, and so is an update that makes the config invalid.
+func (s *server) handlePatchConfig() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failed to read body: %v", err))
+			return
+		}
+		patch, err := decodeConfig(formatJSON, body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failed to decode body: %v", err))
+			return
+		}
+
+		// decodeConfig has already rejected unknown fields and bad values
+		var raw map[string]json.RawMessage
+		json.Unmarshal(body, &raw)
+		var unset []configField
+		for name, value := range raw {
+			if startupFields[name] {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("%s is only read at startup, change it in the config file and restart", name))
+				return
+			}
+			if f, ok := lookupConfigField(name); ok && bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+				unset = append(unset, f)
+			}
+		}
+
+		err = s.update(sourceHTTP, triggerHTTP, requestCaller(r), func(c *serverConfig) error {
+			c.apply(patch)
+			for _, f := range unset {
+				f.unset(c)
+			}
+			return nil
+		})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.config())
+	}
+}
+
+// handlePersistConfig writes the config file layer with the runtime layer
+// over it to the config file, in the file's current format. Values from the
+// defaults, environment and flags are left out, so that they keep applying
+// after a restart.
+func (s *server) handlePersistConfig() http.HandlerFunc {
+	type response struct {
+		Path   string `json:"path"`
+		Format string `json:"format"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		current, _ := ioutil.ReadFile(s.cfgFile)
+		format := detectFormat(s.cfgFile, current)
+
+		persisted := &serverConfig{}
+		s.mu.Lock()
+		persisted.apply(s.layers.file)
+		persisted.apply(s.layers.runtime)
+		s.mu.Unlock()
+
+		body, err := encodeConfig(format, persisted)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to encode config as %s: %v", format, err))
+			return
+		}
+		if err := writeFileAtomic(s.cfgFile, body); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		requestLogger(r, "admin").Info("persisted config", "file", s.cfgFile, "format", format)
+		writeJSON(w, http.StatusOK, response{Path: s.cfgFile, Format: format})
+	}
+}
+
+// handleProvenance reports the effective value of every config field along
+// with the layer that supplied it.
+func (s *server) handleProvenance() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.config().provenance())
+	}
+}
+
+// handleReload reloads the config file and reports the fields that changed.
+func (s *server) handleReload() http.HandlerFunc {
+	type response struct {
+		Changes []fieldChange `json:"changes"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		changes, err := s.reloadFrom(triggerHTTP, requestCaller(r))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+		} else {
+			writeJSON(w, http.StatusOK, response{Changes: changes})
+		}
+	}
+}
+
+// handleAudit returns the audit log of config changes, oldest first.
+func (s *server) handleAudit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.audit.list())
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logger("http").Error("failed to write response", "error", err)
+	}
+}
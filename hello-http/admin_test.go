@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// TestPersistConfig checks that only the config file and runtime values are
+// persisted, so that the environment and defaults keep applying.
+func TestPersistConfig(t *testing.T) {
+	t.Setenv(envPrefix+"LOG_LEVEL", "debug")
+	s := newTestServer(t, map[string]interface{}{"language": "french"})
+
+	if w := serve(s, "PATCH", "/admin/config", `{"debug_mode": true}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH /admin/config: got %d: %s", w.Code, w.Body)
+	}
+	if w := serve(s, "POST", "/admin/config/persist", ""); w.Code != http.StatusOK {
+		t.Fatalf("POST /admin/config/persist: got %d: %s", w.Code, w.Body)
+	}
+
+	body, err := ioutil.ReadFile(s.cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"language": "french", "debug_mode": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("persisted %s, want %v", body, want)
+	}
+}
+
+func TestPatchConfigStartupField(t *testing.T) {
+	s := newTestServer(t, map[string]interface{}{"language": "french"})
+
+	for _, body := range []string{
+		`{"keys_to_watch": ["hello-http/language"]}`,
+		`{"register_port": 9090}`,
+		`{"language": "spanish", "tls_cert_file": "/tmp/cert.pem"}`,
+	} {
+		if w := serve(s, "PATCH", "/admin/config", body); w.Code != http.StatusBadRequest {
+			t.Errorf("PATCH %s: got %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if got := StringVal(s.config().Language); got != "french" {
+		t.Errorf("language is %q after rejected patches, want french", got)
+	}
+}
+
+func TestPatchConfigNull(t *testing.T) {
+	s := newTestServer(t, map[string]interface{}{"language": "french"})
+
+	if w := serve(s, "PATCH", "/admin/config", `{"language": "spanish"}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH /admin/config: got %d: %s", w.Code, w.Body)
+	}
+	if got := StringVal(s.config().Language); got != "spanish" {
+		t.Fatalf("language is %q, want spanish", got)
+	}
+
+	if w := serve(s, "PATCH", "/admin/config", `{"language": null}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH /admin/config: got %d: %s", w.Code, w.Body)
+	}
+	if got := StringVal(s.config().Language); got != "french" {
+		t.Errorf("language is %q after clearing the override, want french", got)
+	}
+	s.mu.Lock()
+	source, ok := s.layers.runtimeSources["language"]
+	s.mu.Unlock()
+	if ok {
+		t.Errorf("language still has runtime source %q", source)
+	}
+}
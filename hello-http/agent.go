@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultConsulAddr resolves the Consul agent address the way the Consul CLI
+// does: CONSUL_HTTP_ADDR, with CONSUL_HTTP_SSL switching a bare or http
+// address to https. Without CONSUL_HTTP_ADDR the agent on HOST_IP is used, or
+// the local one when HOST_IP is not set either.
+// See: https://www.consul.io/docs/commands#environment-variables
+func defaultConsulAddr() string {
+	addr := os.Getenv("CONSUL_HTTP_ADDR")
+	if addr == "" {
+		host := os.Getenv("HOST_IP")
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		addr = net.JoinHostPort(host, "8500")
+	}
+	if strings.HasPrefix(addr, "unix://") {
+		return addr
+	}
+
+	ssl, _ := strconv.ParseBool(os.Getenv("CONSUL_HTTP_SSL"))
+	switch {
+	case strings.HasPrefix(addr, "http://") && ssl:
+		return "https://" + strings.TrimPrefix(addr, "http://")
+	case strings.Contains(addr, "://"):
+		return addr
+	case ssl:
+		return "https://" + addr
+	default:
+		return "http://" + addr
+	}
+}
+
+// validateConsulAddr checks that addr is an http(s) URL with a host or a
+// unix:// socket path.
+func validateConsulAddr(addr string) error {
+	u, err := url.Parse(addr)
+	switch {
+	case err != nil:
+	case u.Scheme == "unix" && u.Path != "":
+		return nil
+	case (u.Scheme == "http" || u.Scheme == "https") && u.Host != "":
+		return nil
+	}
+	return fmt.Errorf("'%s' is not an http(s) URL or unix:// socket path", addr)
+}
+
+// consulAgents sends requests to the configured Consul agents. The agent that
+// last answered is tried first, and the others are tried in order when it is
+// unreachable.
+type consulAgents struct {
+	client *http.Client
+
+	mu        sync.Mutex
+	preferred string
+	sockets   map[string]*http.Client // keyed by socket path
+}
+
+// newConsulAgents creates the HTTP client used for Consul agents, configured
+// for TLS from CONSUL_CACERT, CONSUL_CLIENT_CERT, CONSUL_CLIENT_KEY,
+// CONSUL_TLS_SERVER_NAME and CONSUL_HTTP_SSL_VERIFY like the Consul CLI.
+func newConsulAgents() (*consulAgents, error) {
+	tlsConfig := tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: os.Getenv("CONSUL_TLS_SERVER_NAME"),
+	}
+	if v := os.Getenv("CONSUL_HTTP_SSL_VERIFY"); v != "" {
+		verify, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("CONSUL_HTTP_SSL_VERIFY: %v", err)
+		}
+		tlsConfig.InsecureSkipVerify = !verify
+	}
+	if caFile := os.Getenv("CONSUL_CACERT"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("CONSUL_CACERT: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CONSUL_CACERT: no certificates found in '%s'", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if certFile := os.Getenv("CONSUL_CLIENT_CERT"); certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, os.Getenv("CONSUL_CLIENT_KEY"))
+		if err != nil {
+			return nil, fmt.Errorf("CONSUL_CLIENT_CERT: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tlsConfig
+	return &consulAgents{
+		client: &http.Client{
+			Transport: transport,
+			// Leave headroom over consulWait, Consul adds jitter to blocking
+			// queries
+			Timeout: consulWait + 15*time.Second,
+		},
+		sockets: make(map[string]*http.Client),
+	}, nil
+}
+
+// order returns addrs with the agent that last answered first.
+func (a *consulAgents) order(addrs []string) []string {
+	a.mu.Lock()
+	preferred := a.preferred
+	a.mu.Unlock()
+
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr == preferred {
+			out = append([]string{addr}, out...)
+		} else {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// answered records the agent that last answered.
+func (a *consulAgents) answered(addr string) {
+	a.mu.Lock()
+	a.preferred = addr
+	a.mu.Unlock()
+}
+
+// endpoint returns the base URL and client for an agent address. Requests to
+// a unix socket are sent over a client dialing the socket.
+func (a *consulAgents) endpoint(addr string) (string, *http.Client) {
+	if !strings.HasPrefix(addr, "unix://") {
+		return strings.TrimSuffix(addr, "/"), a.client
+	}
+
+	path := strings.TrimPrefix(addr, "unix://")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	client, ok := a.sockets[path]
+	if !ok {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		client = &http.Client{Transport: transport, Timeout: a.client.Timeout}
+		a.sockets[path] = client
+	}
+	return "http://consul", client
+}
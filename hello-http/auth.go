@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/hcl"
+)
+
+// Authentication methods that can be listed in auth_methods.
+const (
+	authToken     = "token"
+	authMTLS      = "mtls"
+	authConsulACL = "consul-acl"
+)
+
+// aclCacheTTL is how long a Consul ACL token lookup is trusted for.
+const aclCacheTTL = 30 * time.Second
+
+// errNoCredentials is returned by an authenticator when the request does not
+// carry the kind of credentials it checks, so the next one should be tried.
+var errNoCredentials = errors.New("no credentials")
+
+// authenticator identifies the caller of a request. It returns the caller's
+// identity, errNoCredentials, or an error explaining why the credentials were
+// rejected.
+type authenticator interface {
+	authenticate(r *http.Request) (string, error)
+}
+
+// authState holds the authenticators, which cache the token file and ACL
+// lookups between requests.
+type authState struct {
+	tokens *tokenFileAuth
+	acl    *consulACLAuth
+}
+
+func newAuthState(s *server) *authState {
+	return &authState{
+		tokens: &tokenFileAuth{},
+		acl: &consulACLAuth{
+			s:     s,
+			cache: make(map[string]aclCacheEntry),
+		},
+	}
+}
+
+// authenticators returns the authenticators enabled in cfg, in order.
+func (a *authState) authenticators(cfg *serverConfig) []authenticator {
+	var out []authenticator
+	for _, method := range SliceVal(cfg.AuthMethods) {
+		switch method {
+		case authToken:
+			a.tokens.setPath(StringVal(cfg.AuthTokenFile))
+			out = append(out, a.tokens)
+		case authMTLS:
+			out = append(out, mtlsAuth{allowed: SliceVal(cfg.AuthIdentities)})
+		case authConsulACL:
+			out = append(out, a.acl)
+		}
+	}
+	return out
+}
+
+// requireAuth wraps a handler so that it only runs for callers accepted by
+// one of the enabled authenticators, with the caller's identity available
+// from requestCaller. All callers are accepted when no authentication method
+// is enabled.
+func (s *server) requireAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auths := s.auth.authenticators(s.config())
+		if len(auths) == 0 {
+			h(w, r)
+			return
+		}
+
+		var reasons []string
+		for _, a := range auths {
+			id, err := a.authenticate(r)
+			if err == nil {
+				requestLogger(r, "auth").Debug("accepted request", "method", r.Method, "path", r.URL.Path, "caller", id)
+				h(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, id)))
+				return
+			}
+			if err != errNoCredentials {
+				reasons = append(reasons, err.Error())
+			}
+		}
+
+		if len(reasons) == 0 {
+			requestLogger(r, "auth").Warn("denied request", "method", r.Method, "path", r.URL.Path, "caller", callerIdentity(r), "reason", errNoCredentials)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("authentication required"))
+			return
+		}
+		requestLogger(r, "auth").Warn("denied request", "method", r.Method, "path", r.URL.Path, "caller", callerIdentity(r), "reason", strings.Join(reasons, "; "))
+		writeError(w, http.StatusForbidden, errors.New("permission denied"))
+	}
+}
+
+type callerKey struct{}
+
+// requestCaller returns the identity requireAuth accepted the request from, or
+// "" if authentication is disabled.
+func requestCaller(r *http.Request) string {
+	id, _ := r.Context().Value(callerKey{}).(string)
+	return id
+}
+
+// callerIdentity describes the caller of a request for logs: the identity in
+// its client certificate if it presented one, and its address.
+func callerIdentity(r *http.Request) string {
+	if id := peerIdentity(r); id != "" {
+		return fmt.Sprintf("%s (%s)", id, r.RemoteAddr)
+	}
+	return r.RemoteAddr
+}
+
+// peerIdentity returns the identity in the verified client certificate of a
+// request: its first URI SAN, DNS SAN or common name, in that order. It
+// returns "" if the client did not present a verified certificate.
+func peerIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	default:
+		return cert.Subject.CommonName
+	}
+}
+
+// bearerToken returns the token from the Authorization header, if any.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+		return strings.TrimSpace(h[len(prefix):])
+	}
+	return ""
+}
+
+// tokenFileAuth accepts bearer tokens listed in a file. Each non-empty line
+// that is not a comment holds a token, optionally prefixed by a name for logs
+// as in `name:token`. The file is read again whenever it changes.
+type tokenFileAuth struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	tokens  map[string]string // token -> name
+}
+
+func (t *tokenFileAuth) setPath(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if path != t.path {
+		t.path = path
+		t.modTime = time.Time{}
+		t.tokens = nil
+	}
+}
+
+func (t *tokenFileAuth) authenticate(r *http.Request) (string, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return "", errNoCredentials
+	}
+
+	tokens, err := t.load()
+	if err != nil {
+		requestLogger(r, "auth").Error("failed to load token file", "error", err)
+		return "", errors.New("token file unavailable")
+	}
+	for known, name := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return "token:" + name, nil
+		}
+	}
+	return "", errors.New("unknown bearer token")
+}
+
+// load returns the tokens in the file, reading it again if it changed.
+func (t *tokenFileAuth) load() (map[string]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.path == "" {
+		return nil, errors.New("auth_token_file is not set")
+	}
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat token file '%s': %v", t.path, err)
+	}
+	if t.tokens != nil && info.ModTime().Equal(t.modTime) {
+		return t.tokens, nil
+	}
+
+	body, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file '%s': %v", t.path, err)
+	}
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, token := "line "+strconv.Itoa(n), line
+		if i := strings.Index(line, ":"); i > 0 {
+			name, token = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		tokens[token] = name
+	}
+
+	t.tokens = tokens
+	t.modTime = info.ModTime()
+	return tokens, nil
+}
+
+// mtlsAuth accepts callers that presented a verified client certificate.
+// When allowed is not empty the certificate's identity must be listed in it.
+type mtlsAuth struct {
+	allowed []string
+}
+
+func (m mtlsAuth) authenticate(r *http.Request) (string, error) {
+	id := peerIdentity(r)
+	if id == "" {
+		return "", errNoCredentials
+	}
+	if len(m.allowed) == 0 {
+		return id, nil
+	}
+	for _, allowed := range m.allowed {
+		if id == allowed {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("client identity '%s' is not allowed", id)
+}
+
+// consulACLAuth accepts callers whose token, sent as a bearer token or in
+// X-Consul-Token, is a valid Consul ACL token granting service:write on the
+// service, as registering it would require. The token's policies and roles
+// are read with the service's own token, which needs acl:read for them.
+type consulACLAuth struct {
+	s *server
+
+	mu    sync.Mutex
+	cache map[string]aclCacheEntry // keyed by token hash
+}
+
+type aclCacheEntry struct {
+	identity string
+	service  string
+	expires  time.Time
+}
+
+// aclGlobalManagement is the ID of Consul's built-in policy that grants every
+// permission.
+const aclGlobalManagement = "00000000-0000-0000-0000-000000000001"
+
+// aclToken is the part of an ACL token, or of a role, that grants permissions.
+type aclToken struct {
+	AccessorID        string
+	Policies          []aclLink
+	Roles             []aclLink
+	ServiceIdentities []aclServiceIdentity
+}
+
+// aclLink refers to a policy or a role.
+type aclLink struct {
+	ID   string
+	Name string
+}
+
+type aclServiceIdentity struct {
+	ServiceName string
+}
+
+// aclRules holds the service rules of ACL policies.
+// See: https://www.consul.io/docs/security/acl/acl-rules
+type aclRules struct {
+	Service       []aclRule `hcl:"service,expand"`
+	ServicePrefix []aclRule `hcl:"service_prefix,expand"`
+}
+
+type aclRule struct {
+	Name   string `hcl:",key"`
+	Policy string `hcl:"policy"`
+}
+
+func (c *consulACLAuth) authenticate(r *http.Request) (string, error) {
+	token := r.Header.Get("X-Consul-Token")
+	if token == "" {
+		token = bearerToken(r)
+	}
+	if token == "" {
+		return "", errNoCredentials
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	key := string(sum[:])
+
+	service := StringVal(c.s.config().RegisterName)
+
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && entry.service == service && time.Now().Before(entry.expires) {
+		return entry.identity, nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	resp, err := c.s.consulDo(ctx, "GET", "/v1/acl/token/self", nil, token)
+	if err != nil {
+		requestLogger(r, "auth").Error("failed to look up ACL token", "error", err)
+		return "", errors.New("ACL token lookup failed")
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		requestLogger(r, "auth").Error("Consul does not serve /v1/acl/token/self, the consul-acl auth method needs Consul 1.4 or later",
+			"consul_addr", StringVal(c.s.config().ConsulAddr))
+		return "", errors.New("consul-acl auth method is misconfigured")
+	default:
+		return "", fmt.Errorf("ACL token rejected by Consul. code: %d", resp.StatusCode)
+	}
+
+	var self aclToken
+	if err := json.Unmarshal(resp.Body, &self); err != nil {
+		return "", fmt.Errorf("failed to decode ACL token: %v", err)
+	}
+	identity := "consul-acl:" + self.AccessorID
+
+	allowed, err := c.allowsServiceWrite(ctx, self, service)
+	if err != nil {
+		requestLogger(r, "auth").Error("failed to check ACL token permissions", "error", err)
+		return "", errors.New("ACL token permission check failed")
+	}
+	if !allowed {
+		return "", fmt.Errorf("ACL token '%s' lacks service:write on '%s'", self.AccessorID, service)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	for k, e := range c.cache {
+		if now.After(e.expires) {
+			delete(c.cache, k)
+		}
+	}
+	c.cache[key] = aclCacheEntry{identity: identity, service: service, expires: now.Add(aclCacheTTL)}
+	c.mu.Unlock()
+
+	return identity, nil
+}
+
+// allowsServiceWrite reports whether token grants service:write on service.
+// A service identity grants it on its own service. Otherwise the service rules
+// of the token's policies, directly or through its roles, are evaluated the
+// way Consul does: a service rule for the exact name wins over service_prefix
+// rules, the longest prefix wins among those, and when several policies have
+// a rule for the same name deny wins over write, and write over read. Names
+// without any rule are denied, whatever the default policy of the cluster.
+func (c *consulACLAuth) allowsServiceWrite(ctx context.Context, token aclToken, service string) (bool, error) {
+	policies := token.Policies
+	identities := token.ServiceIdentities
+	for _, link := range token.Roles {
+		var role aclToken
+		if err := c.read(ctx, "/v1/acl/role/"+link.ID, &role); err != nil {
+			return false, err
+		}
+		policies = append(policies, role.Policies...)
+		identities = append(identities, role.ServiceIdentities...)
+	}
+
+	for _, identity := range identities {
+		if identity.ServiceName == service {
+			return true, nil
+		}
+	}
+
+	var rules aclRules
+	for _, link := range policies {
+		if link.ID == aclGlobalManagement {
+			return true, nil
+		}
+		var policy struct {
+			Rules string
+		}
+		if err := c.read(ctx, "/v1/acl/policy/"+link.ID, &policy); err != nil {
+			return false, err
+		}
+		var r aclRules
+		if err := hcl.Decode(&r, policy.Rules); err != nil {
+			return false, fmt.Errorf("failed to parse the rules of ACL policy '%s': %v", link.Name, err)
+		}
+		rules.Service = append(rules.Service, r.Service...)
+		rules.ServicePrefix = append(rules.ServicePrefix, r.ServicePrefix...)
+	}
+
+	access := ""
+	for _, rule := range rules.Service {
+		if rule.Name == service {
+			access = mergeACLAccess(access, rule.Policy)
+		}
+	}
+	if access == "" {
+		longest := -1
+		for _, rule := range rules.ServicePrefix {
+			if !strings.HasPrefix(service, rule.Name) || len(rule.Name) < longest {
+				continue
+			}
+			if len(rule.Name) > longest {
+				longest, access = len(rule.Name), ""
+			}
+			access = mergeACLAccess(access, rule.Policy)
+		}
+	}
+	return access == "write", nil
+}
+
+// read reads an ACL object with the service's own token.
+func (c *consulACLAuth) read(ctx context.Context, path string, out interface{}) error {
+	resp, err := c.s.consulGet(ctx, path, 0)
+	if errors.Is(err, errACLDenied) {
+		return fmt.Errorf("%v, the service's token needs acl:read for the consul-acl auth method", err)
+	}
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to read '%s'. code: %d, resp: %s", path, resp.StatusCode, resp.Body)
+	}
+	if err := json.Unmarshal(resp.Body, out); err != nil {
+		return fmt.Errorf("failed to decode '%s': %v", path, err)
+	}
+	return nil
+}
+
+// mergeACLAccess returns the access that wins when two policies have a rule
+// for the same name.
+func mergeACLAccess(a, b string) string {
+	rank := map[string]int{"read": 1, "write": 2, "deny": 3}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
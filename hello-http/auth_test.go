@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newFakeACLAgent returns a Consul agent that knows the tokens, roles and
+// policies given, keyed by secret and ID.
+func newFakeACLAgent(t *testing.T, tokens map[string]aclToken, roles map[string]aclToken, policies map[string]string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			out interface{}
+			ok  bool
+		)
+		switch {
+		case r.URL.Path == "/v1/acl/token/self":
+			out, ok = tokens[r.Header.Get("X-Consul-Token")]
+			if !ok {
+				http.Error(w, "ACL not found", http.StatusForbidden)
+				return
+			}
+		case strings.HasPrefix(r.URL.Path, "/v1/acl/role/"):
+			out, ok = roles[strings.TrimPrefix(r.URL.Path, "/v1/acl/role/")]
+		case strings.HasPrefix(r.URL.Path, "/v1/acl/policy/"):
+			var rules string
+			rules, ok = policies[strings.TrimPrefix(r.URL.Path, "/v1/acl/policy/")]
+			out = map[string]string{"Rules": rules}
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(out)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestConsulACLAuth(t *testing.T) {
+	policies := map[string]string{
+		"web-write":   `service "web" { policy = "write" }`,
+		"web-read":    `service "web" { policy = "read" }`,
+		"web-deny":    `service "web" { policy = "deny" }`,
+		"all-write":   `service_prefix "" { policy = "write" }`,
+		"we-deny":     `service_prefix "we" { policy = "deny" }`,
+		"json-write":  `{"service": {"web": {"policy": "write"}}}`,
+		"other-write": `service "webapp" { policy = "write" }`,
+	}
+	roles := map[string]aclToken{
+		"deployer": {Policies: []aclLink{{ID: "web-write"}}},
+		"web":      {ServiceIdentities: []aclServiceIdentity{{ServiceName: "web"}}},
+	}
+	token := func(policies ...string) aclToken {
+		tok := aclToken{AccessorID: "accessor"}
+		for _, p := range policies {
+			tok.Policies = append(tok.Policies, aclLink{ID: p, Name: p})
+		}
+		return tok
+	}
+
+	tests := []struct {
+		name  string
+		token aclToken
+		code  int
+	}{
+		{"service rule", token("web-write"), http.StatusOK},
+		{"service rule in JSON", token("json-write"), http.StatusOK},
+		{"read only", token("web-read"), http.StatusForbidden},
+		{"other service", token("other-write"), http.StatusForbidden},
+		{"no policies", token(), http.StatusForbidden},
+		{"prefix rule", token("all-write"), http.StatusOK},
+		{"exact rule wins over prefix", token("all-write", "web-read"), http.StatusForbidden},
+		{"longest prefix wins", token("all-write", "we-deny"), http.StatusForbidden},
+		{"deny wins over write", token("web-write", "web-deny"), http.StatusForbidden},
+		{"global management", token(aclGlobalManagement), http.StatusOK},
+		{"service identity", aclToken{ServiceIdentities: []aclServiceIdentity{{ServiceName: "web"}}}, http.StatusOK},
+		{"role policy", aclToken{Roles: []aclLink{{ID: "deployer"}}}, http.StatusOK},
+		{"role service identity", aclToken{Roles: []aclLink{{ID: "web"}}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newFakeACLAgent(t, map[string]aclToken{"secret": tt.token}, roles, policies)
+			s := newTestServer(t, map[string]interface{}{
+				"consul_addr":   ts.URL,
+				"register_name": "web",
+				"auth_methods":  []string{authConsulACL},
+			})
+
+			req := httptest.NewRequest("GET", "/admin/config", nil)
+			req.Header.Set("X-Consul-Token", "secret")
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, req)
+			if w.Code != tt.code {
+				t.Errorf("got %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+		})
+	}
+}
+
+// TestConsulACLAuthNotFound checks that an agent without the token endpoint,
+// such as one older than Consul 1.4, is reported as a misconfiguration.
+func TestConsulACLAuthNotFound(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	s := newTestServer(t, map[string]interface{}{
+		"consul_addr":  ts.URL,
+		"auth_methods": []string{authConsulACL},
+	})
+
+	req := httptest.NewRequest("GET", "/admin/config", nil)
+	req.Header.Set("X-Consul-Token", "secret")
+	_, err := s.auth.acl.authenticate(req)
+	if err == nil || !strings.Contains(err.Error(), "misconfigured") {
+		t.Errorf("got error %v, want a misconfiguration", err)
+	}
+}
@@ -1,79 +1,120 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
-	"sync"
+	"strings"
+	"time"
 )
 
+// serverConfig is published as an immutable snapshot, see server.update.
+// Fields are pointers so that unset values can be told apart when the config
+// layers are stacked.
 type serverConfig struct {
-	mu           sync.RWMutex
-	Language     *string   `json:"language"`
+	Language     *string   `json:"language" kv:"language"`
 	ConsulAddr   *string   `json:"consul_addr"`
 	KVPath       *string   `json:"kv_path"`
 	ServiceName  *string   `json:"service_name"`
 	TTLEndpoint  *string   `json:"ttl_endpoint"`
 	TTLID        *string   `json:"ttl_id"`
-	EnableChecks *bool     `json:"enable_checks"`
-	DebugMode    *bool     `json:"debug_mode"`
+	EnableChecks *bool     `json:"enable_checks" kv:"enable_checks,service"`
+	DebugMode    *bool     `json:"debug_mode" kv:"debug_mode,service"`
 	ToWatch      *[]string `json:"keys_to_watch"`
+	AuditKVKey   *string   `json:"audit_kv_key"`
+
+	// Level of the logs, one of debug, info, warn or error. debug_mode
+	// lowers it to debug, logging raw Consul responses too
+	LogLevel *string `json:"log_level" kv:"log_level,service"`
+
+	// Consul agents tried in order when the one in use cannot be reached
+	ConsulFallbackAddrs *[]string `json:"consul_fallback_addrs"`
+
+	// Registration of the service with the Consul agent. The ID defaults to
+	// service_name without its trailing '/', the port to the listen port, and
+	// meta entries are written as "key=value"
+	RegisterService *bool     `json:"register_service"`
+	RegisterName    *string   `json:"register_name"`
+	RegisterID      *string   `json:"register_id"`
+	RegisterAddress *string   `json:"register_address"`
+	RegisterPort    *int      `json:"register_port"`
+	RegisterTags    *[]string `json:"register_tags"`
+	RegisterMeta    *[]string `json:"register_meta"`
+	CheckInterval   *string   `json:"check_interval"`
+	CheckTTL        *string   `json:"check_ttl"`
+
+	// Health checks. Thresholds of 0 are not checked, custom HTTP checks are
+	// written as "name=url", and health_consul_checks registers every check
+	// as a separate Consul TTL check
+	HealthMaxGoroutines *int      `json:"health_max_goroutines"`
+	HealthMaxHeapMB     *int      `json:"health_max_heap_mb"`
+	HealthKVMaxAge      *string   `json:"health_kv_max_age"`
+	HealthHTTPChecks    *[]string `json:"health_http_checks"`
+	HealthCheckInterval *string   `json:"health_check_interval"`
+	HealthCheckTimeout  *string   `json:"health_check_timeout"`
+	HealthConsulChecks  *bool     `json:"health_consul_checks"`
+
+	// How long to keep serving with failing health checks before shutting
+	// down, so that Consul and DNS stop routing to the service first
+	DrainPeriod *string `json:"drain_period"`
+
+	// Authentication for the mutating health and admin endpoints
+	AuthMethods    *[]string `json:"auth_methods"`
+	AuthTokenFile  *string   `json:"auth_token_file"`
+	AuthIdentities *[]string `json:"auth_allowed_identities"`
+
+	// Serve HTTPS when both are set, and require client certificates signed
+	// by the CAs in tls_ca_file when it is set
+	TLSCertFile *string `json:"tls_cert_file"`
+	TLSKeyFile  *string `json:"tls_key_file"`
+	TLSCAFile   *string `json:"tls_ca_file"`
+
+	// sources records the layer each field was taken from.
+	sources map[string]string
 }
 
-func (c *serverConfig) merge(other *serverConfig) *serverConfig {
-	o := *other
-	if c == nil {
-		return &o
-	}
-	if c.Language == nil {
-		c.Language = o.Language
-	}
-	if c.ConsulAddr == nil {
-		c.ConsulAddr = o.ConsulAddr
-	}
-	if c.KVPath == nil {
-		c.KVPath = o.KVPath
-	}
-	if c.ServiceName == nil {
-		c.ServiceName = o.ServiceName
-	}
-	if c.TTLEndpoint == nil {
-		c.TTLEndpoint = o.TTLEndpoint
-	}
-	if c.TTLID == nil {
-		c.TTLID = o.TTLID
-	}
-	if c.EnableChecks == nil {
-		c.EnableChecks = o.EnableChecks
-	}
-	if c.DebugMode == nil {
-		c.DebugMode = o.DebugMode
-	}
-	if c.ToWatch == nil {
-		c.ToWatch = o.ToWatch
-	}
-	return c
+// clone returns a shallow copy of the config. Fields must be replaced rather
+// than written through, since the pointers are shared with the original.
+func (c *serverConfig) clone() *serverConfig {
+	o := *c
+	return &o
 }
 
 func defaultConfig() *serverConfig {
 	return &serverConfig{
 		Language:     StringPtr("english"),
-		ConsulAddr:   StringPtr(fmt.Sprintf("http://%s:8500", os.Getenv("HOST_IP"))),
+		ConsulAddr:   StringPtr(defaultConsulAddr()),
 		KVPath:       StringPtr("/v1/kv/service/hello/"),
 		ServiceName:  StringPtr("hello-http/"),
-		TTLEndpoint:  StringPtr("/v1/agent/check/pass/"),
+		TTLEndpoint:  StringPtr("/v1/agent/check/update/"),
 		TTLID:        StringPtr("hello-ttl"),
 		EnableChecks: BoolPtr(true),
 		DebugMode:    BoolPtr(false),
-		ToWatch:      SlicePtr([]string{"hello-http/enable_checks"}),
+		ToWatch:      SlicePtr([]string{"hello-http/enable_checks", "hello-http/debug_mode"}),
+		LogLevel:     StringPtr("info"),
+
+		RegisterService: BoolPtr(true),
+		RegisterName:    StringPtr("hello"),
+		RegisterAddress: StringPtr(os.Getenv("POD_IP")),
+		CheckInterval:   StringPtr("1s"),
+		CheckTTL:        StringPtr("5s"),
+		DrainPeriod:     StringPtr("5s"),
+
+		HealthMaxGoroutines: IntPtr(10000),
+		HealthMaxHeapMB:     IntPtr(512),
+		HealthKVMaxAge:      StringPtr("5m"),
+		HealthCheckInterval: StringPtr("10s"),
+		HealthCheckTimeout:  StringPtr("2s"),
+		HealthConsulChecks:  BoolPtr(false),
 	}
 }
 
 func loadConfig(filename string) (*serverConfig, error) {
 	f, err := os.Open(filename)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open '%s': %v", filename, err)
+		return nil, fmt.Errorf("failed to open '%s': %w", filename, err)
 	}
 	defer f.Close()
 
@@ -82,10 +123,123 @@ func loadConfig(filename string) (*serverConfig, error) {
 		return nil, fmt.Errorf("failed to read '%s': %v", filename, err)
 	}
 
-	var cfg serverConfig
-	json.Unmarshal(body, &cfg)
+	format := detectFormat(filename, body)
+	cfg, err := decodeConfig(format, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode '%s' as %s: %v", filename, format, err)
+	}
+	return cfg, nil
+}
+
+// validate checks the config for semantic errors. All problems are
+// reported, not just the first one.
+func (c *serverConfig) validate() error {
+	var errs []error
+
+	if err := validateConsulAddr(StringVal(c.ConsulAddr)); err != nil {
+		errs = append(errs, fmt.Errorf("consul_addr: %v", err))
+	}
+	for _, addr := range SliceVal(c.ConsulFallbackAddrs) {
+		if err := validateConsulAddr(addr); err != nil {
+			errs = append(errs, fmt.Errorf("consul_fallback_addrs: %v", err))
+		}
+	}
+	if err := validateLanguage(StringVal(c.Language)); err != nil {
+		errs = append(errs, fmt.Errorf("language: %v", err))
+	}
+	if name := StringVal(c.ServiceName); len(name) < 2 || !strings.HasSuffix(name, "/") {
+		errs = append(errs, fmt.Errorf("service_name: '%s' must be a name ending in '/'", name))
+	}
+	if _, err := parseLogLevel(StringVal(c.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("log_level: %v", err))
+	}
+
+	for _, method := range SliceVal(c.AuthMethods) {
+		switch method {
+		case authToken:
+			if StringVal(c.AuthTokenFile) == "" {
+				errs = append(errs, fmt.Errorf("auth_token_file: must be set to use the '%s' auth method", authToken))
+			}
+		case authMTLS, authConsulACL:
+		default:
+			errs = append(errs, fmt.Errorf("auth_methods: unknown method '%s'", method))
+		}
+	}
+
+	if port := IntVal(c.RegisterPort); port < 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("register_port: %d is not a valid port", port))
+	}
+	for _, entry := range SliceVal(c.RegisterMeta) {
+		if strings.Index(entry, "=") < 1 {
+			errs = append(errs, fmt.Errorf("register_meta: '%s' must be written as key=value", entry))
+		}
+	}
+	if _, err := time.ParseDuration(StringVal(c.CheckInterval)); err != nil {
+		errs = append(errs, fmt.Errorf("check_interval: %v", err))
+	}
+	if _, err := time.ParseDuration(StringVal(c.CheckTTL)); err != nil {
+		errs = append(errs, fmt.Errorf("check_ttl: %v", err))
+	}
+
+	if IntVal(c.HealthMaxGoroutines) < 0 {
+		errs = append(errs, errors.New("health_max_goroutines: must not be negative"))
+	}
+	if IntVal(c.HealthMaxHeapMB) < 0 {
+		errs = append(errs, errors.New("health_max_heap_mb: must not be negative"))
+	}
+	if _, err := time.ParseDuration(StringVal(c.HealthKVMaxAge)); err != nil {
+		errs = append(errs, fmt.Errorf("health_kv_max_age: %v", err))
+	}
+	for _, entry := range SliceVal(c.HealthHTTPChecks) {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			errs = append(errs, fmt.Errorf("health_http_checks: '%s' must be written as name=url", entry))
+			continue
+		}
+		if u, err := url.Parse(kv[1]); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("health_http_checks: '%s' is not an http or https URL", kv[1]))
+		}
+	}
+	if d, err := time.ParseDuration(StringVal(c.HealthCheckInterval)); err != nil {
+		errs = append(errs, fmt.Errorf("health_check_interval: %v", err))
+	} else if d <= 0 {
+		errs = append(errs, errors.New("health_check_interval: must be positive"))
+	}
+	if d, err := time.ParseDuration(StringVal(c.HealthCheckTimeout)); err != nil {
+		errs = append(errs, fmt.Errorf("health_check_timeout: %v", err))
+	} else if d <= 0 {
+		errs = append(errs, errors.New("health_check_timeout: must be positive"))
+	}
+
+	if _, err := time.ParseDuration(StringVal(c.DrainPeriod)); err != nil {
+		errs = append(errs, fmt.Errorf("drain_period: %v", err))
+	}
+
+	if (StringVal(c.TLSCertFile) == "") != (StringVal(c.TLSKeyFile) == "") {
+		errs = append(errs, errors.New("tls_cert_file, tls_key_file: must be set together"))
+	}
+	if StringVal(c.TLSCAFile) != "" && StringVal(c.TLSCertFile) == "" {
+		errs = append(errs, errors.New("tls_ca_file: requires tls_cert_file and tls_key_file"))
+	}
 
-	return &cfg, nil
+	keys := SliceVal(c.ToWatch)
+	if len(keys) == 0 {
+		errs = append(errs, errors.New("keys_to_watch: must not be empty"))
+	}
+	for i, key := range keys {
+		if strings.TrimSpace(key) == "" {
+			errs = append(errs, fmt.Errorf("keys_to_watch: key %d is empty", i))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateLanguage(lang string) error {
+	if _, ok := greetings[lang]; !ok {
+		return fmt.Errorf("unknown language '%s'", lang)
+	}
+	return nil
 }
 
 // BoolPtr returns a pointer to the given bool.
@@ -116,6 +270,20 @@ func StringVal(s *string) string {
 	return *s
 }
 
+// IntPtr returns a pointer to the given int.
+func IntPtr(i int) *int {
+	return &i
+}
+
+// IntVal returns the value of the int at the pointer, or 0 if the pointer is
+// nil.
+func IntVal(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
+
 // SlicePtr returns a pointer to the given string slice.
 func SlicePtr(s []string) *[]string {
 	return &s
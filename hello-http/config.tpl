@@ -1,5 +1,5 @@
 {
-  "language": {{ keyOrDefault "service/hello/language" "english" }},
+  "language": "{{ keyOrDefault "service/hello/language" "english" }}",
   "enable_checks": true,
   "service_name": "hello-http/"
 }
\ No newline at end of file
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// connectAuthorizeTimeout bounds the intention check made during each TLS
+// handshake.
+const connectAuthorizeTimeout = 5 * time.Second
+
+// connectRootsPath is the agent endpoint serving the Connect CA roots.
+const connectRootsPath = "/v1/agent/connect/ca/roots"
+
+// connectTLS serves TLS as a Connect-native service. The leaf certificate and
+// the CA roots are fetched from the local Consul agent and kept current with
+// blocking queries, and every connection is checked against the service's
+// intentions.
+// See: https://www.consul.io/docs/connect/native
+type connectTLS struct {
+	s       *server
+	service string
+
+	// Indexes of the initial fetches, the watches continue from them
+	leafIndex  uint64
+	rootsIndex uint64
+
+	mu    sync.RWMutex
+	leaf  *tls.Certificate
+	roots *x509.CertPool
+}
+
+// leafResponse is the subset of /v1/agent/connect/ca/leaf/<service> used.
+type leafResponse struct {
+	SerialNumber  string
+	CertPEM       string
+	PrivateKeyPEM string
+	ValidBefore   time.Time
+}
+
+// rootsResponse is the subset of /v1/agent/connect/ca/roots used.
+type rootsResponse struct {
+	TrustDomain string
+	Roots       []struct {
+		ID       string
+		RootCert string
+	}
+}
+
+// newConnectTLS fetches the initial leaf certificate and roots for service.
+func newConnectTLS(ctx context.Context, s *server, service string) (*connectTLS, error) {
+	c := connectTLS{s: s, service: service}
+
+	var err error
+	if c.leafIndex, err = c.fetch(ctx, c.leafPath(), 0, c.setLeaf); err != nil {
+		return nil, err
+	}
+	if c.rootsIndex, err = c.fetch(ctx, connectRootsPath, 0, c.setRoots); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *connectTLS) leafPath() string {
+	return "/v1/agent/connect/ca/leaf/" + url.PathEscape(c.service)
+}
+
+// watch keeps the leaf certificate and roots current until ctx is done.
+func (c *connectTLS) watch(ctx context.Context) {
+	go c.watchPath(ctx, c.leafPath(), c.leafIndex, c.setLeaf)
+	c.watchPath(ctx, connectRootsPath, c.rootsIndex, c.setRoots)
+}
+
+// watchPath makes blocking queries against path and applies every new result.
+func (c *connectTLS) watchPath(ctx context.Context, path string, index uint64, apply func([]byte) error) {
+	limiter := rate.NewLimiter(limiterRate, limiterBurst)
+
+	for {
+		// Only fails once ctx is done
+		if err := limiter.Wait(ctx); err != nil {
+			return
+		}
+
+		// Reset if it goes backwards or is 0
+		// See: https://www.consul.io/api/features/blocking.html#implementation-details
+		if index == 0 {
+			index = 1
+		}
+		next, err := c.fetch(ctx, path, index, apply)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger("connect").Error("watch failed", "path", path, "error", err)
+			continue
+		}
+		if next < index {
+			index = 0
+			continue
+		}
+		index = next
+	}
+}
+
+// fetch queries path and applies the result if its index moved past index.
+func (c *connectTLS) fetch(ctx context.Context, path string, index uint64, apply func([]byte) error) (uint64, error) {
+	resp, err := c.s.consulGet(ctx, path, index)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to get '%s'. code: %d, resp: %s", path, resp.StatusCode, resp.Body)
+	}
+	if index == 0 || resp.Index > index {
+		if err := apply(resp.Body); err != nil {
+			return 0, err
+		}
+	}
+	return resp.Index, nil
+}
+
+func (c *connectTLS) setLeaf(body []byte) error {
+	var leaf leafResponse
+	if err := json.Unmarshal(body, &leaf); err != nil {
+		return fmt.Errorf("failed to decode leaf certificate: %v", err)
+	}
+	cert, err := tls.X509KeyPair([]byte(leaf.CertPEM), []byte(leaf.PrivateKeyPEM))
+	if err != nil {
+		return fmt.Errorf("failed to parse leaf certificate: %v", err)
+	}
+
+	c.mu.Lock()
+	c.leaf = &cert
+	c.mu.Unlock()
+
+	logger("connect").Info("loaded leaf certificate", "serial", leaf.SerialNumber, "service", c.service,
+		"valid_until", leaf.ValidBefore.Format(time.RFC3339))
+	return nil
+}
+
+func (c *connectTLS) setRoots(body []byte) error {
+	var roots rootsResponse
+	if err := json.Unmarshal(body, &roots); err != nil {
+		return fmt.Errorf("failed to decode CA roots: %v", err)
+	}
+	pool := x509.NewCertPool()
+	for _, root := range roots.Roots {
+		if !pool.AppendCertsFromPEM([]byte(root.RootCert)) {
+			return fmt.Errorf("failed to parse CA root '%s'", root.ID)
+		}
+	}
+
+	c.mu.Lock()
+	c.roots = pool
+	c.mu.Unlock()
+
+	logger("connect").Info("loaded CA roots", "count", len(roots.Roots), "trust_domain", roots.TrustDomain)
+	return nil
+}
+
+// tlsConfig returns a server TLS config that always uses the latest leaf
+// certificate and roots, and only accepts clients allowed by intentions.
+func (c *connectTLS) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: c.getConfigForClient,
+	}
+}
+
+func (c *connectTLS) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		Certificates:     []tls.Certificate{*c.leaf},
+		ClientCAs:        c.roots,
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		VerifyConnection: c.authorize,
+	}, nil
+}
+
+// authorize asks the local agent whether the client's certificate is allowed
+// to connect to the service by its intentions.
+// See: https://www.consul.io/api/agent/connect.html#authorize
+func (c *connectTLS) authorize(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("connect: client did not present a certificate")
+	}
+	cert := cs.PeerCertificates[0]
+	if len(cert.URIs) == 0 {
+		return errors.New("connect: client certificate has no URI SAN")
+	}
+
+	req, err := json.Marshal(map[string]string{
+		"Target":           c.service,
+		"ClientCertURI":    cert.URIs[0].String(),
+		"ClientCertSerial": serialString(cert),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectAuthorizeTimeout)
+	defer cancel()
+
+	resp, err := c.s.consulDo(ctx, "POST", "/v1/agent/connect/authorize", req, "")
+	if err != nil {
+		logger("connect").Error("failed to authorize client", "client", cert.URIs[0].String(), "error", err)
+		return errors.New("connect: authorization failed")
+	}
+	if resp.StatusCode != http.StatusOK {
+		logger("connect").Error("failed to authorize client", "client", cert.URIs[0].String(), "code", resp.StatusCode, "response", string(resp.Body))
+		return errors.New("connect: authorization failed")
+	}
+
+	var result struct {
+		Authorized bool
+		Reason     string
+	}
+	if err := json.Unmarshal(resp.Body, &result); err != nil {
+		return fmt.Errorf("connect: failed to decode authorization: %v", err)
+	}
+	if !result.Authorized {
+		logger("connect").Warn("denied client", "client", cert.URIs[0].String(), "reason", result.Reason)
+		return fmt.Errorf("connect: not authorized: %s", result.Reason)
+	}
+	return nil
+}
+
+// listenAndServe serves the router on addr as a Connect-native service.
+func (c *connectTLS) listenAndServe(addr string) error {
+	srv := http.Server{
+		Addr:      addr,
+		Handler:   c.s.router,
+		TLSConfig: c.tlsConfig(),
+		ErrorLog:  stdLogger("http", slog.LevelWarn),
+	}
+	c.s.life.onStop("http", srv.Shutdown)
+	logger("connect").Info("serving over Connect TLS", "service", c.service, "addr", addr)
+	return srv.ListenAndServeTLS("", "")
+}
+
+// connectDefinition returns the Connect configuration to register the service
+// with: Connect-native when serving with certificates from the agent.
+func (s *server) connectDefinition() *agentServiceConnect {
+	if s.connect == nil {
+		return nil
+	}
+	return &agentServiceConnect{Native: true}
+}
+
+// serialString formats a certificate serial number the way Consul does, as
+// colon separated hex bytes.
+func serialString(cert *x509.Certificate) string {
+	b := cert.SerialNumber.Bytes()
+	parts := make([]string, len(b))
+	for i := range b {
+		parts[i] = fmt.Sprintf("%02x", b[i])
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testTrustDomain = "11111111-2222-3333-4444-555555555555.consul"
+
+// fakeConnectAgent serves the Connect endpoints of a Consul agent, issuing
+// leaf certificates from an in-process CA. Intentions allow the services in
+// allowed to connect and deny every other one.
+type fakeConnectAgent struct {
+	ca      *testCert
+	allowed map[string]bool
+
+	mu         sync.Mutex
+	authorized []map[string]string
+}
+
+func newFakeConnectAgent(t *testing.T, allowed ...string) (*fakeConnectAgent, *httptest.Server) {
+	a := fakeConnectAgent{ca: generateCA(t, "Consul CA"), allowed: make(map[string]bool)}
+	for _, service := range allowed {
+		a.allowed[service] = true
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agent/connect/ca/leaf/", func(w http.ResponseWriter, r *http.Request) {
+		leaf := a.leaf(t, strings.TrimPrefix(r.URL.Path, "/v1/agent/connect/ca/leaf/"))
+		w.Header().Set("X-Consul-Index", "10")
+		json.NewEncoder(w).Encode(leafResponse{
+			SerialNumber:  serialString(leaf.cert),
+			CertPEM:       string(leaf.certPEM),
+			PrivateKeyPEM: string(leaf.keyPEM),
+			ValidBefore:   leaf.cert.NotAfter,
+		})
+	})
+	mux.HandleFunc(connectRootsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "5")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"TrustDomain": testTrustDomain,
+			"Roots":       []map[string]string{{"ID": "root", "RootCert": string(a.ca.certPEM)}},
+		})
+	})
+	mux.HandleFunc("/v1/agent/connect/authorize", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		a.mu.Lock()
+		a.authorized = append(a.authorized, req)
+		a.mu.Unlock()
+
+		uri, err := url.Parse(req["ClientCertURI"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		client := path.Base(uri.Path)
+		result := map[string]interface{}{"Authorized": a.allowed[client], "Reason": "ACL: deny by default"}
+		if a.allowed[client] {
+			result["Reason"] = "Matched intention: " + client + " => " + req["Target"] + " (allow)"
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return &a, ts
+}
+
+// leaf issues a certificate for service from the agent's CA.
+func (a *fakeConnectAgent) leaf(t *testing.T, service string) *testCert {
+	return issueLeaf(t, a.ca, testTrustDomain, service)
+}
+
+// issueLeaf issues a Connect leaf certificate for service, signed by ca.
+func issueLeaf(t *testing.T, ca *testCert, trustDomain, service string) *testCert {
+	uri := &url.URL{Scheme: "spiffe", Host: trustDomain, Path: "/ns/default/dc/dc1/svc/" + service}
+	return generateCert(t, &x509.Certificate{
+		URIs:        []*url.URL{uri},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, ca)
+}
+
+func TestConnectTLS(t *testing.T) {
+	agent, ts := newFakeConnectAgent(t, "web")
+	s := newTestServer(t, map[string]interface{}{"consul_addr": ts.URL})
+	c, err := newConnectTLS(context.Background(), s, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, s, c.tlsConfig())
+
+	tests := []struct {
+		name   string
+		client *testCert
+		ok     bool
+	}{
+		{"allowed by intentions", agent.leaf(t, "web"), true},
+		{"denied by intentions", agent.leaf(t, "db"), false},
+		{"other CA", issueLeaf(t, generateCA(t, "Other CA"), testTrustDomain, "web"), false},
+		{"no client certificate", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roots := x509.NewCertPool()
+			roots.AddCert(agent.ca.cert)
+			cfg := &tls.Config{
+				// The leaf identifies the service by URI SAN only, so the
+				// server is checked against the CA below
+				InsecureSkipVerify: true,
+				RootCAs:            roots,
+			}
+			if tt.client != nil {
+				pair, err := tls.X509KeyPair(tt.client.certPEM, tt.client.keyPEM)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg.Certificates = []tls.Certificate{pair}
+			}
+
+			conn, err := tls.Dial("tcp", addr, cfg)
+			if err == nil {
+				defer conn.Close()
+				server := conn.ConnectionState().PeerCertificates[0]
+				if _, err := server.Verify(x509.VerifyOptions{Roots: roots}); err != nil {
+					t.Errorf("server certificate: %v", err)
+				}
+				if got := server.URIs[0].String(); !strings.HasSuffix(got, "/svc/hello") {
+					t.Errorf("server certificate identifies %s", got)
+				}
+				// With TLS 1.3 the server rejects the client after the client
+				// finished the handshake
+				_, err = getHello(conn)
+			}
+			if ok := err == nil; ok != tt.ok {
+				t.Errorf("got error %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+
+	// The agent was asked about the allowed client's certificate
+	want := map[string]string{
+		"Target":           "hello",
+		"ClientCertURI":    tests[0].client.cert.URIs[0].String(),
+		"ClientCertSerial": serialString(tests[0].client.cert),
+	}
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if len(agent.authorized) != 2 {
+		t.Fatalf("got %d authorize requests, want 2", len(agent.authorized))
+	}
+	for k, v := range want {
+		if got := agent.authorized[0][k]; got != v {
+			t.Errorf("authorize %s: got %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestSerialString(t *testing.T) {
+	cert := generateServerCert(t, 0x0a1b2c)
+	if got := serialString(cert.cert); got != "0a:1b:2c" {
+		t.Errorf("got %q, want %q", got, "0a:1b:2c")
+	}
+}
+
+// TestConnectRegistration checks that a Connect-native service is registered
+// as one, so that Consul routes Connect traffic to it.
+func TestConnectRegistration(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/v1/agent/service/register" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer ts.Close()
+	s := newTestServer(t, map[string]interface{}{"consul_addr": ts.URL})
+
+	tests := []struct {
+		name    string
+		connect *connectTLS
+		want    interface{}
+	}{
+		{"connect native", &connectTLS{}, map[string]interface{}{"Native": true}},
+		{"plain", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.connect = tt.connect
+			if err := s.registerService(context.Background(), s.serviceDefinition(s.config(), 8080)); err != nil {
+				t.Fatal(err)
+			}
+			var def map[string]interface{}
+			if err := json.Unmarshal(<-bodies, &def); err != nil {
+				t.Fatal(err)
+			}
+			if got := def["Connect"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("registered Connect %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// consulWait is how long a blocking query may be held open by Consul.
+const consulWait = time.Minute
+
+// errACLDenied is returned when Consul rejects a request made with the
+// service's own ACL token.
+var errACLDenied = errors.New("permission denied by Consul ACLs")
+
+var consulACLDenials = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "consul_acl_denied_total",
+		Help: "Count of Consul API requests rejected by ACLs.",
+	}, []string{"method", "path"})
+
+func init() {
+	prometheus.MustRegister(consulACLDenials)
+}
+
+// consulResponse is the result of a query against the Consul HTTP API.
+type consulResponse struct {
+	StatusCode int
+	Index      uint64
+	Body       []byte
+}
+
+// consulGet queries the Consul HTTP API at path. A non-zero index turns it
+// into a blocking query that returns once the result changes past index or
+// consulWait elapses.
+// See: https://www.consul.io/api/features/blocking.html
+func (s *server) consulGet(ctx context.Context, path string, index uint64) (*consulResponse, error) {
+	if index > 0 {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += fmt.Sprintf("%sindex=%d&wait=%s", sep, index, consulWait)
+	}
+	return s.consulDo(ctx, "GET", path, nil, "")
+}
+
+// consulPut sends body to the Consul HTTP API at path.
+func (s *server) consulPut(ctx context.Context, path string, body []byte) (*consulResponse, error) {
+	return s.consulDo(ctx, "PUT", path, body, "")
+}
+
+// consulDo sends a request to the Consul HTTP API. A non-empty token is sent
+// as the request's ACL token, otherwise the service's own token is used and a
+// 403 response is returned as errACLDenied. The agents in consul_addr and
+// consul_fallback_addrs are tried in turn until one can be reached.
+func (s *server) consulDo(ctx context.Context, method, path string, body []byte, token string) (*consulResponse, error) {
+	cfg := s.config()
+	ownToken := token == ""
+	if ownToken {
+		token = s.token.get()
+	}
+
+	addrs := s.consul.order(append([]string{StringVal(cfg.ConsulAddr)}, SliceVal(cfg.ConsulFallbackAddrs)...))
+	var (
+		resp  *http.Response
+		err   error
+		agent string
+	)
+	for i, addr := range addrs {
+		resp, err = s.consulSend(ctx, addr, method, path, body, token)
+		if err == nil {
+			s.consul.answered(addr)
+			agent = addr
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if i < len(addrs)-1 {
+			logger("consul").Warn("agent unreachable, trying the next one", "error", err, "next", addrs[i+1])
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	endpoint := strings.SplitN(path, "?", 2)[0]
+	if l := logger("consul"); l.Enabled(ctx, slog.LevelDebug) {
+		logBody := string(respBody)
+		if strings.HasPrefix(endpoint, "/v1/acl/") || strings.HasPrefix(endpoint, "/v1/agent/connect/ca/leaf/") {
+			// Tokens and private keys stay out of the logs
+			logBody = "<redacted>"
+		}
+		l.Debug("response", "method", method, "path", path, "agent", agent, "code", resp.StatusCode,
+			"index", resp.Header.Get("X-Consul-Index"), "body", logBody)
+	}
+	if ownToken {
+		if resp.StatusCode == http.StatusForbidden {
+			s.aclDenied(method, endpoint, respBody)
+			return nil, fmt.Errorf("failed to %s '%s': %w", method, endpoint, errACLDenied)
+		}
+		s.aclAllowed(method, endpoint)
+	}
+
+	out := consulResponse{
+		StatusCode: resp.StatusCode,
+		Body:       respBody,
+	}
+	if indexStr := resp.Header.Get("X-Consul-Index"); indexStr != "" {
+		out.Index, err = strconv.ParseUint(indexStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse X-Consul-Index: %v", err)
+		}
+	}
+	return &out, nil
+}
+
+// consulSend sends a request to the agent at addr.
+func (s *server) consulSend(ctx context.Context, addr, method, path string, body []byte, token string) (*http.Response, error) {
+	base, client := s.consul.endpoint(addr)
+	target := base + path
+
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s '%s' on agent '%s': %v", method, path, addr, err)
+	}
+	return resp, nil
+}
+
+// aclDenied counts a request rejected by ACLs. Only the first rejection of an
+// endpoint is logged, until a request to it succeeds again.
+func (s *server) aclDenied(method, endpoint string, body []byte) {
+	consulACLDenials.WithLabelValues(method, endpoint).Inc()
+
+	key := method + " " + endpoint
+	if _, logged := s.denied.LoadOrStore(key, true); !logged {
+		logger("consul").Warn("request denied by ACLs, further denials are counted in consul_acl_denied_total",
+			"method", method, "path", endpoint, "response", string(bytes.TrimSpace(body)))
+	}
+}
+
+// aclAllowed records that a request was accepted, so that a later rejection
+// is logged again.
+func (s *server) aclAllowed(method, endpoint string) {
+	if _, logged := s.denied.LoadAndDelete(method + " " + endpoint); logged {
+		logger("consul").Info("request allowed by ACLs again", "method", method, "path", endpoint)
+	}
+}
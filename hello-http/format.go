@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported config file formats.
+const (
+	formatJSON = "json"
+	formatHCL  = "hcl"
+	formatYAML = "yaml"
+)
+
+// hclAssignment matches a top-level HCL attribute such as `language = "french"`.
+var hclAssignment = regexp.MustCompile(`(?m)^\s*[A-Za-z_][\w-]*\s*=`)
+
+// detectFormat picks the format of a config file from its extension, falling
+// back to sniffing the content when the extension is not recognized.
+func detectFormat(filename string, body []byte) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return formatJSON
+	case ".hcl":
+		return formatHCL
+	case ".yaml", ".yml":
+		return formatYAML
+	}
+
+	switch {
+	case bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")):
+		return formatJSON
+	case hclAssignment.Match(body):
+		return formatHCL
+	default:
+		return formatYAML
+	}
+}
+
+// decodeConfig decodes a config in the given format. HCL and YAML are first
+// decoded into a generic map and then go through the same strict JSON
+// decoding, so all formats share field names and reject unknown fields.
+func decodeConfig(format string, body []byte) (*serverConfig, error) {
+	switch format {
+	case formatJSON:
+	case formatHCL:
+		var m map[string]interface{}
+		if err := hcl.Unmarshal(body, &m); err != nil {
+			return nil, fmt.Errorf("invalid HCL: %v", err)
+		}
+		var err error
+		if body, err = json.Marshal(m); err != nil {
+			return nil, err
+		}
+	case formatYAML:
+		var m map[string]interface{}
+		if err := yaml.Unmarshal(body, &m); err != nil {
+			return nil, fmt.Errorf("invalid YAML: %v", err)
+		}
+		var err error
+		if body, err = json.Marshal(m); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format '%s'", format)
+	}
+
+	var cfg serverConfig
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after config object")
+	}
+	return &cfg, nil
+}
+
+// encodeConfig encodes the set fields of a config in the given format.
+func encodeConfig(format string, cfg *serverConfig) ([]byte, error) {
+	fields := make(map[string]interface{})
+	for _, f := range configFields {
+		if v := f.get(cfg); v != nil {
+			fields[f.name] = v
+		}
+	}
+
+	switch format {
+	case formatJSON:
+		return json.MarshalIndent(fields, "", "  ")
+
+	case formatHCL:
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		// Strings, bools, numbers and lists of strings are written the same
+		// way in HCL as in JSON
+		var buf bytes.Buffer
+		for _, name := range names {
+			v, err := json.Marshal(fields[name])
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&buf, "%s = %s\n", name, v)
+		}
+		return buf.Bytes(), nil
+
+	case formatYAML:
+		return yaml.Marshal(fields)
+	}
+	return nil, fmt.Errorf("unsupported config format '%s'", format)
+}
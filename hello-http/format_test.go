@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestConfigRoundTrip encodes a config in every format and checks that
+// decoding it gives back every field.
+func TestConfigRoundTrip(t *testing.T) {
+	cfg := &serverConfig{
+		Language:        StringPtr("french"),
+		ConsulAddr:      StringPtr("https://consul.example.com:8501"),
+		EnableChecks:    BoolPtr(false),
+		DebugMode:       BoolPtr(true),
+		ToWatch:         SlicePtr([]string{"hello-http/enable_checks", "language"}),
+		RegisterPort:    IntPtr(8443),
+		RegisterTags:    SlicePtr([]string{"v1"}),
+		RegisterMeta:    SlicePtr([]string{"version=1", "team=platform"}),
+		HealthMaxHeapMB: IntPtr(0),
+		DrainPeriod:     StringPtr("30s"),
+	}
+
+	for _, format := range []string{formatJSON, formatHCL, formatYAML} {
+		t.Run(format, func(t *testing.T) {
+			body, err := encodeConfig(format, cfg)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			got, err := decodeConfig(format, body)
+			if err != nil {
+				t.Fatalf("decode: %v\n%s", err, body)
+			}
+			for _, f := range configFields {
+				if want, have := f.get(cfg), f.get(got); !reflect.DeepEqual(want, have) {
+					t.Errorf("%s: got %#v, want %#v\n%s", f.name, have, want, body)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		body   string
+		err    string
+	}{
+		{
+			name:   "json",
+			format: formatJSON,
+			body:   `{"language": "french", "register_port": 8443, "register_tags": ["a", "b"], "debug_mode": true}`,
+		},
+		{
+			name:   "hcl",
+			format: formatHCL,
+			body:   "language = \"french\"\nregister_port = 8443\nregister_tags = [\"a\", \"b\"]\ndebug_mode = true\n",
+		},
+		{
+			name:   "yaml",
+			format: formatYAML,
+			body:   "language: french\nregister_port: 8443\nregister_tags:\n  - a\n  - b\ndebug_mode: true\n",
+		},
+		{
+			name:   "json unknown field",
+			format: formatJSON,
+			body:   `{"language": "french", "langauge": "spanish"}`,
+			err:    `unknown field "langauge"`,
+		},
+		{
+			name:   "hcl unknown field",
+			format: formatHCL,
+			body:   "langauge = \"spanish\"\n",
+			err:    `unknown field "langauge"`,
+		},
+		{
+			name:   "yaml unknown field",
+			format: formatYAML,
+			body:   "langauge: spanish\n",
+			err:    `unknown field "langauge"`,
+		},
+		{
+			name:   "json trailing data",
+			format: formatJSON,
+			body:   `{"language": "french"} {}`,
+			err:    "unexpected data after config object",
+		},
+		{
+			name:   "yaml wrong type",
+			format: formatYAML,
+			body:   "register_port: eighty\n",
+			err:    "register_port",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := decodeConfig(tt.format, []byte(tt.body))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := StringVal(cfg.Language); got != "french" {
+				t.Errorf("language: got %q", got)
+			}
+			if got := IntVal(cfg.RegisterPort); got != 8443 {
+				t.Errorf("register_port: got %d", got)
+			}
+			if got := SliceVal(cfg.RegisterTags); !reflect.DeepEqual(got, []string{"a", "b"}) {
+				t.Errorf("register_tags: got %q", got)
+			}
+			if !BoolVal(cfg.DebugMode) {
+				t.Error("debug_mode: got false")
+			}
+		})
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		filename string
+		body     string
+		want     string
+	}{
+		{"config.json", "", formatJSON},
+		{"config.HCL", "", formatHCL},
+		{"config.yml", "", formatYAML},
+		{"config", `{"language": "french"}`, formatJSON},
+		{"config", `language = "french"`, formatHCL},
+		{"config", "language: french", formatYAML},
+	}
+	for _, tt := range tests {
+		if got := detectFormat(tt.filename, []byte(tt.body)); got != tt.want {
+			t.Errorf("detectFormat(%q, %q): got %s, want %s", tt.filename, tt.body, got, tt.want)
+		}
+	}
+}
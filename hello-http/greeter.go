@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	hellov1 "github.com/freddygv/consul-getting-started/hello-http/proto/hello/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	grpcRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_requests_total",
+			Help: "Count of gRPC requests processed, by method and status code.",
+		},
+		[]string{"method", "code"},
+	)
+	grpcDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "grpc_request_duration_seconds",
+			Help:    "Latency of unary gRPC requests, by method.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"method"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(grpcRequests, grpcDuration)
+}
+
+// unaryMetrics counts and times unary gRPC requests.
+func unaryMetrics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	grpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	grpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+// streamMetrics counts streaming gRPC requests once they end.
+func streamMetrics(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(srv, ss)
+	grpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return err
+}
+
+// greeter serves the hello.v1.Greeter gRPC service.
+type greeter struct {
+	s *server
+
+	// stopping is closed when the gRPC server stops, ending the
+	// WatchGreeting streams so that it can stop gracefully.
+	stopping chan struct{}
+}
+
+func (g *greeter) SayHello(ctx context.Context, req *hellov1.SayHelloRequest) (*hellov1.SayHelloResponse, error) {
+	greeting, lang := g.s.greeting()
+	return &hellov1.SayHelloResponse{Greeting: greeting, Language: lang}, nil
+}
+
+// WatchGreeting sends the current greeting, then a new one every time the
+// language changes.
+func (g *greeter) WatchGreeting(req *hellov1.WatchGreetingRequest, stream hellov1.Greeter_WatchGreetingServer) error {
+	changed := g.s.configChanged.subscribe()
+	defer g.s.configChanged.unsubscribe(changed)
+
+	var last string
+	for {
+		if greeting, lang := g.s.greeting(); lang != last {
+			if err := stream.Send(&hellov1.WatchGreetingResponse{Greeting: greeting, Language: lang}); err != nil {
+				return err
+			}
+			last = lang
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-g.stopping:
+			return nil
+		case <-changed:
+		}
+	}
+}
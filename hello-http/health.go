@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Check statuses, as reported to Consul.
+const (
+	statusPassing  = "passing"
+	statusWarning  = "warning"
+	statusCritical = "critical"
+)
+
+// statusRank orders the statuses from best to worst.
+var statusRank = map[string]int{
+	statusPassing:  0,
+	statusWarning:  1,
+	statusCritical: 2,
+}
+
+const (
+	// Interval and timeout of the built-in checks on Consul
+	consulCheckInterval = 10 * time.Second
+	consulCheckTimeout  = 5 * time.Second
+
+	// Interval and timeout of the built-in checks on the process itself
+	runtimeCheckInterval = 5 * time.Second
+	runtimeCheckTimeout  = time.Second
+
+	// httpCheckPrefix names the checks taken from health_http_checks.
+	httpCheckPrefix = "http:"
+)
+
+// healthResult is the status of the service or of one of its checks, and a
+// human-readable reason for it.
+type healthResult struct {
+	Status string `json:"status"`
+	Output string `json:"output"`
+}
+
+// checkUpdate is the body of a TTL check update.
+// See: https://www.consul.io/api/agent/check.html#ttl-check-update
+type checkUpdate struct {
+	Status string
+	Output string
+}
+
+// healthEvaluator decides the health of the service. It is consulted on every
+// TTL update and health request.
+type healthEvaluator interface {
+	evaluate() healthResult
+}
+
+// healthCheck is a named check run by the health registry every interval.
+// Each run is given timeout to complete, after which it is critical.
+type healthCheck struct {
+	name     string
+	interval time.Duration
+	timeout  time.Duration
+	run      func(ctx context.Context) healthResult
+
+	// spec describes what the check does, such as the URL of an HTTP check.
+	// Registering a check with the same spec, interval and timeout as the
+	// running one keeps the running one.
+	spec string
+}
+
+// checkResult is the latest result of a registered check.
+type checkResult struct {
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	Output   string    `json:"output"`
+	Interval string    `json:"interval"`
+	Updated  time.Time `json:"updated"`
+
+	check healthCheck
+}
+
+// healthRegistry runs the named checks that make up the health of the
+// service. Checks may be registered and replaced at any time.
+type healthRegistry struct {
+	// onResult is called after every run of a check. changed reports whether
+	// its status or output differs from the previous run.
+	onResult func(name string, res healthResult, changed bool)
+
+	mu      sync.Mutex
+	ctx     context.Context
+	results map[string]*checkResult
+	cancels map[string]context.CancelFunc
+
+	// changed is notified whenever the health of the service may have
+	// changed.
+	changed broadcast
+}
+
+func newHealthRegistry(onResult func(name string, res healthResult, changed bool)) *healthRegistry {
+	return &healthRegistry{
+		onResult: onResult,
+		results:  make(map[string]*checkResult),
+		cancels:  make(map[string]context.CancelFunc),
+	}
+}
+
+// register adds a check, replacing any check of the same name. It starts
+// running right away if the registry is running.
+func (r *healthRegistry) register(c healthCheck) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cur, ok := r.results[c.name]; ok && c.spec != "" && cur.check.spec == c.spec &&
+		cur.check.interval == c.interval && cur.check.timeout == c.timeout {
+		return
+	}
+	if cancel, ok := r.cancels[c.name]; ok {
+		cancel()
+		delete(r.cancels, c.name)
+	}
+	r.results[c.name] = &checkResult{
+		Name:     c.name,
+		Status:   statusPassing,
+		Output:   "Check has not run yet",
+		Interval: c.interval.String(),
+		check:    c,
+	}
+	if r.ctx != nil {
+		r.start(c)
+	}
+}
+
+// deregister stops and removes a check.
+func (r *healthRegistry) deregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cancel, ok := r.cancels[name]; ok {
+		cancel()
+		delete(r.cancels, name)
+	}
+	delete(r.results, name)
+}
+
+// run starts the registered checks, and those registered later, until ctx is
+// done.
+func (r *healthRegistry) run(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ctx = ctx
+	for _, res := range r.results {
+		r.start(res.check)
+	}
+}
+
+// start runs c in the background. r.mu must be held.
+func (r *healthRegistry) start(c healthCheck) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	r.cancels[c.name] = cancel
+
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			res := c.run(checkCtx)
+			if checkCtx.Err() == context.DeadlineExceeded {
+				res = healthResult{statusCritical, fmt.Sprintf("Check timed out after %s", c.timeout)}
+			}
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			r.record(c.name, res)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// record stores the result of a run and reports it to onResult.
+func (r *healthRegistry) record(name string, res healthResult) {
+	r.mu.Lock()
+	cur, ok := r.results[name]
+	if !ok {
+		// Deregistered while running
+		r.mu.Unlock()
+		return
+	}
+	changed := cur.Status != res.Status || cur.Output != res.Output
+	cur.Status, cur.Output, cur.Updated = res.Status, res.Output, time.Now()
+	r.mu.Unlock()
+
+	if r.onResult != nil {
+		r.onResult(name, res, changed)
+	}
+}
+
+// list returns the latest results of the checks, sorted by name.
+func (r *healthRegistry) list() []checkResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]checkResult, 0, len(r.results))
+	for _, res := range r.results {
+		list = append(list, *res)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// aggregateHealth is critical while the service is not ready, and otherwise
+// takes the worst status of the registered checks.
+type aggregateHealth struct {
+	s *server
+}
+
+func (h aggregateHealth) evaluate() healthResult {
+	if ok, output := h.s.ready(); !ok {
+		return healthResult{statusCritical, output}
+	}
+
+	checks := h.s.checks.list()
+	worst := statusPassing
+	var failing []string
+	for _, c := range checks {
+		if c.Status == statusPassing {
+			continue
+		}
+		failing = append(failing, fmt.Sprintf("%s: %s", c.Name, c.Output))
+		if statusRank[c.Status] > statusRank[worst] {
+			worst = c.Status
+		}
+	}
+	if len(failing) > 0 {
+		return healthResult{worst, strings.Join(failing, "; ")}
+	}
+	return healthResult{statusPassing, fmt.Sprintf("All %d checks passing", len(checks))}
+}
+
+// healthChanged notifies the health subscribers of a change that may affect
+// the health of the service, such as a config change or a check result.
+func (s *server) healthChanged() {
+	s.checks.changed.notify()
+}
+
+// registerBuiltinChecks registers the checks every service runs.
+func (s *server) registerBuiltinChecks() {
+	started := time.Now()
+	s.checks.register(healthCheck{
+		name:     "consul_agent",
+		interval: consulCheckInterval,
+		timeout:  consulCheckTimeout,
+		run:      s.checkConsulAgent,
+	})
+	s.checks.register(healthCheck{
+		name:     "consul_acl",
+		interval: consulCheckInterval,
+		timeout:  consulCheckTimeout,
+		run:      s.checkConsulACL,
+	})
+	s.checks.register(healthCheck{
+		name:     "kv_watch",
+		interval: consulCheckInterval,
+		timeout:  consulCheckTimeout,
+		run: func(ctx context.Context) healthResult {
+			return s.checkKVWatch(started)
+		},
+	})
+	s.checks.register(healthCheck{
+		name:     "goroutines",
+		interval: runtimeCheckInterval,
+		timeout:  runtimeCheckTimeout,
+		run:      s.checkGoroutines,
+	})
+	s.checks.register(healthCheck{
+		name:     "heap",
+		interval: runtimeCheckInterval,
+		timeout:  runtimeCheckTimeout,
+		run:      s.checkHeap,
+	})
+}
+
+// checkConsulAgent warns when no Consul agent can be reached or the cluster
+// has no leader.
+func (s *server) checkConsulAgent(ctx context.Context) healthResult {
+	resp, err := s.consulGet(ctx, "/v1/status/leader", 0)
+	if err != nil {
+		return healthResult{statusWarning, fmt.Sprintf("Consul agent is unreachable: %v", err)}
+	}
+	var leader string
+	json.Unmarshal(resp.Body, &leader)
+	if resp.StatusCode != http.StatusOK || leader == "" {
+		return healthResult{statusWarning, "Consul cluster has no leader"}
+	}
+	return healthResult{statusPassing, fmt.Sprintf("Consul agent is reachable, leader is %s", leader)}
+}
+
+// checkConsulACL warns while Consul ACLs deny some of the service's requests.
+func (s *server) checkConsulACL(ctx context.Context) healthResult {
+	var denied []string
+	s.denied.Range(func(key, _ interface{}) bool {
+		denied = append(denied, key.(string))
+		return true
+	})
+	if len(denied) > 0 {
+		sort.Strings(denied)
+		return healthResult{statusWarning, "Consul ACLs deny " + strings.Join(denied, ", ")}
+	}
+	return healthResult{statusPassing, "Consul ACLs allow all requests"}
+}
+
+// checkKVWatch warns when a watched key has not been synced from Consul for
+// longer than health_kv_max_age, counting from started for keys that were
+// never synced.
+func (s *server) checkKVWatch(started time.Time) healthResult {
+	cfg := s.config()
+	maxAge, _ := time.ParseDuration(StringVal(cfg.HealthKVMaxAge))
+
+	var stale []string
+	for _, key := range SliceVal(cfg.ToWatch) {
+		if maxAge == 0 {
+			break
+		}
+		synced, ok := s.synced.Load(key)
+		switch {
+		case !ok:
+			if time.Since(started) > maxAge {
+				stale = append(stale, fmt.Sprintf("'%s' never synced", key))
+			}
+		case time.Since(synced.(time.Time)) > maxAge:
+			stale = append(stale, fmt.Sprintf("'%s' last synced %s ago", key, time.Since(synced.(time.Time)).Round(time.Second)))
+		}
+	}
+	if len(stale) > 0 {
+		return healthResult{statusWarning, "KV watches are stale: " + strings.Join(stale, ", ")}
+	}
+	return healthResult{statusPassing, "KV watches are up to date"}
+}
+
+// checkGoroutines warns when more goroutines than health_max_goroutines are
+// running.
+func (s *server) checkGoroutines(ctx context.Context) healthResult {
+	limit, n := IntVal(s.config().HealthMaxGoroutines), runtime.NumGoroutine()
+	if limit > 0 && n > limit {
+		return healthResult{statusWarning, fmt.Sprintf("%d goroutines running, more than %d", n, limit)}
+	}
+	return healthResult{statusPassing, fmt.Sprintf("%d goroutines running", n)}
+}
+
+// checkHeap warns when the heap holds more than health_max_heap_mb.
+func (s *server) checkHeap(ctx context.Context) healthResult {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	limit, mb := IntVal(s.config().HealthMaxHeapMB), int(stats.HeapAlloc>>20)
+	if limit > 0 && mb > limit {
+		return healthResult{statusWarning, fmt.Sprintf("%d MB of heap in use, more than %d MB", mb, limit)}
+	}
+	return healthResult{statusPassing, fmt.Sprintf("%d MB of heap in use", mb)}
+}
+
+// syncHTTPChecks registers the custom checks in health_http_checks, and
+// removes those no longer listed. Unchanged checks keep running.
+func (s *server) syncHTTPChecks(cfg *serverConfig) {
+	interval, _ := time.ParseDuration(StringVal(cfg.HealthCheckInterval))
+	timeout, _ := time.ParseDuration(StringVal(cfg.HealthCheckTimeout))
+
+	want := make(map[string]string)
+	for _, entry := range SliceVal(cfg.HealthHTTPChecks) {
+		kv := strings.SplitN(entry, "=", 2)
+		want[httpCheckPrefix+kv[0]] = kv[1]
+	}
+
+	for _, res := range s.checks.list() {
+		if _, ok := want[res.Name]; !ok && strings.HasPrefix(res.Name, httpCheckPrefix) {
+			s.checks.deregister(res.Name)
+		}
+	}
+	for name, target := range want {
+		s.checks.register(healthCheck{
+			name:     name,
+			interval: interval,
+			timeout:  timeout,
+			run:      httpCheck(target),
+			spec:     target,
+		})
+	}
+}
+
+// httpCheck returns a check that GETs target. As with Consul HTTP checks, a
+// 2xx response is passing, 429 is warning and anything else is critical.
+func httpCheck(target string) func(ctx context.Context) healthResult {
+	return func(ctx context.Context) healthResult {
+		req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			return healthResult{statusCritical, err.Error()}
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return healthResult{statusCritical, err.Error()}
+		}
+		resp.Body.Close()
+
+		output := fmt.Sprintf("GET %s: %s", target, resp.Status)
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return healthResult{statusPassing, output}
+		case resp.StatusCode == http.StatusTooManyRequests:
+			return healthResult{statusWarning, output}
+		}
+		return healthResult{statusCritical, output}
+	}
+}
+
+// onCheckResult is the health registry's onResult. Changes are passed
+// on to healthChanged, and with health_consul_checks enabled every result is
+// also reported to the check's own Consul TTL check.
+func (s *server) onCheckResult(name string, res healthResult, changed bool) {
+	if changed {
+		logger("health").Info("check changed", "check_id", name, "status", res.Status, "output", res.Output)
+		s.healthChanged()
+	}
+
+	cfg := s.config()
+	if !BoolVal(cfg.HealthConsulChecks) || !BoolVal(cfg.RegisterService) {
+		return
+	}
+	body, _ := json.Marshal(checkUpdate{res.Status, res.Output})
+	id := checkID(serviceID(cfg), name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), consulCheckTimeout)
+	defer cancel()
+	resp, err := s.consulPut(ctx, StringVal(cfg.TTLEndpoint)+url.PathEscape(id), body)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		// The agent may not have registered the check yet
+		err = fmt.Errorf("code: %d, resp: %s", resp.StatusCode, resp.Body)
+	}
+	ttlUpdates.WithLabelValues(id, result(err)).Inc()
+	if err != nil && changed {
+		logger("health").Warn("failed to update Consul check", "check_id", id, "error", err)
+	}
+}
+
+// healthCheckDefinitions returns a TTL check for every registered check when
+// health_consul_checks is enabled. Their TTL allows for a few missed runs.
+func (s *server) healthCheckDefinitions(cfg *serverConfig, svc agentService) []agentCheck {
+	if !BoolVal(cfg.HealthConsulChecks) {
+		return nil
+	}
+
+	var checks []agentCheck
+	for _, res := range s.checks.list() {
+		checks = append(checks, agentCheck{
+			CheckID: checkID(svc.ID, res.Name),
+			Name:    fmt.Sprintf("%s health check", res.Name),
+			TTL:     (3 * res.check.interval).String(),
+		})
+	}
+	return checks
+}
+
+// checkID is the Consul check ID of the named health check.
+func checkID(serviceID, name string) string {
+	return serviceID + ":" + name
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errUnknownKey is returned when a watched key does not map to any
+// serverConfig field.
+var errUnknownKey = errors.New("key does not map to a config field")
+
+// kvField describes a serverConfig field that can be driven from Consul KV.
+// Fields opt in with a `kv` struct tag. The tag holds the key name relative
+// to kv_path, optionally followed by ",service" when the key is scoped under
+// the service name. For example:
+//
+//	Language     *string `kv:"language"`               // <kv_path>language
+//	EnableChecks *bool   `kv:"enable_checks,service"`  // <kv_path><service_name>enable_checks
+type kvField struct {
+	name   string
+	scoped bool
+	field  configField
+}
+
+// key returns the full key for the field relative to kv_path.
+func (f kvField) key(serviceName string) string {
+	if f.scoped {
+		return serviceName + f.name
+	}
+	return f.name
+}
+
+// kvFields is the registry of KV-driven fields, built from the struct tags of
+// serverConfig.
+var kvFields = buildKVFields()
+
+func buildKVFields() []kvField {
+	var fields []kvField
+
+	t := reflect.TypeOf(serverConfig{})
+	for _, cf := range configFields {
+		sf := t.Field(cf.index)
+		tag, ok := sf.Tag.Lookup("kv")
+		if !ok || tag == "-" {
+			continue
+		}
+
+		parts := strings.Split(tag, ",")
+		f := kvField{
+			name:  parts[0],
+			field: cf,
+		}
+		for _, opt := range parts[1:] {
+			switch opt {
+			case "service":
+				f.scoped = true
+			default:
+				panic(fmt.Sprintf("kv field %s has unknown tag option '%s'", sf.Name, opt))
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// lookupKVField finds the field for a key relative to kv_path.
+func lookupKVField(key, serviceName string) (kvField, bool) {
+	for _, f := range kvFields {
+		if f.key(serviceName) == key {
+			return f, true
+		}
+	}
+	return kvField{}, false
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// parseFieldValue converts a raw string from Consul KV, the environment or a
+// flag into a value of the given type. Lists are comma separated.
+func parseFieldValue(typ reflect.Type, raw string) (reflect.Value, error) {
+	raw = strings.TrimSpace(raw)
+
+	if typ == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("failed to parse duration '%s': %v", raw, err)
+		}
+		return reflect.ValueOf(d), nil
+	}
+
+	switch typ.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(raw).Convert(typ), nil
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("failed to parse bool '%s': %v", raw, err)
+		}
+		return reflect.ValueOf(b).Convert(typ), nil
+
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("failed to parse int '%s': %v", raw, err)
+		}
+		return reflect.ValueOf(n).Convert(typ), nil
+
+	case reflect.Slice:
+		if typ.Elem().Kind() != reflect.String {
+			break
+		}
+		list := make([]string, 0)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return reflect.ValueOf(list).Convert(typ), nil
+	}
+	return reflect.Value{}, fmt.Errorf("unsupported field type %s", typ)
+}
+
+// setKV parses the value of a watched key and stores it in the matching
+// serverConfig field.
+func (s *server) setKV(key, raw string) error {
+	return s.update(sourceKV, triggerKVWatch, "", func(c *serverConfig) error {
+		f, ok := lookupKVField(key, StringVal(s.config().ServiceName))
+		if !ok {
+			return errUnknownKey
+		}
+		return f.field.set(c, raw)
+	})
+}
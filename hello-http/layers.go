@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Sources a config value can come from. The first five are the config layers
+// from lowest to highest precedence. Values set at runtime through the HTTP
+// API share the top layer with values from Consul KV.
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+	sourceKV      = "kv"
+	sourceHTTP    = "http"
+)
+
+// envPrefix is prepended to the upper-cased field name to form the
+// environment variable for a field, e.g. HELLO_LANGUAGE.
+const envPrefix = "HELLO_"
+
+// configField describes a field of serverConfig, named after its json tag.
+type configField struct {
+	name  string
+	index int
+	typ   reflect.Type
+}
+
+// configFields lists every field of serverConfig that can be configured.
+var configFields = buildConfigFields()
+
+// fieldValidators holds optional validation hooks keyed by field name. They
+// are run on the parsed value before it is set, whatever the source.
+var fieldValidators = map[string]func(v interface{}) error{
+	"language": func(v interface{}) error {
+		return validateLanguage(v.(string))
+	},
+}
+
+// startupFields are only read when the service starts, so they cannot be
+// changed at runtime: the watches, the listener's certificates, and the
+// registered port, which must match the listener.
+var startupFields = map[string]bool{
+	"keys_to_watch": true,
+	"register_port": true,
+	"tls_cert_file": true,
+	"tls_key_file":  true,
+	"tls_ca_file":   true,
+}
+
+func buildConfigFields() []configField {
+	var fields []configField
+
+	t := reflect.TypeOf(serverConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if sf.PkgPath != "" || name == "" || name == "-" {
+			continue
+		}
+		if sf.Type.Kind() != reflect.Ptr {
+			panic(fmt.Sprintf("config field %s must be a pointer", sf.Name))
+		}
+		fields = append(fields, configField{
+			name:  name,
+			index: i,
+			typ:   sf.Type.Elem(),
+		})
+	}
+	return fields
+}
+
+// lookupConfigField returns the field named name.
+func lookupConfigField(name string) (configField, bool) {
+	for _, f := range configFields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return configField{}, false
+}
+
+// get returns the field of c, or nil if it is unset.
+func (f configField) get(c *serverConfig) interface{} {
+	v := reflect.ValueOf(c).Elem().Field(f.index)
+	if v.IsNil() {
+		return nil
+	}
+	return v.Elem().Interface()
+}
+
+// set parses raw and stores it in the field of c. A fresh pointer is always
+// stored, since the old one may be shared with published snapshots.
+func (f configField) set(c *serverConfig, raw string) error {
+	val, err := parseFieldValue(f.typ, raw)
+	if err != nil {
+		return err
+	}
+	if validate, ok := fieldValidators[f.name]; ok {
+		if err := validate(val.Interface()); err != nil {
+			return err
+		}
+	}
+
+	ptr := reflect.New(f.typ)
+	ptr.Elem().Set(val)
+	reflect.ValueOf(c).Elem().Field(f.index).Set(ptr)
+	return nil
+}
+
+// unset clears the field of c.
+func (f configField) unset(c *serverConfig) {
+	v := reflect.ValueOf(c).Elem().Field(f.index)
+	v.Set(reflect.Zero(v.Type()))
+}
+
+// overlay copies every field that is set in other onto c and records the
+// source of each copied field.
+func (c *serverConfig) overlay(other *serverConfig, source func(name string) string) {
+	if other == nil {
+		return
+	}
+	dst := reflect.ValueOf(c).Elem()
+	src := reflect.ValueOf(other).Elem()
+	for _, f := range configFields {
+		v := src.Field(f.index)
+		if v.IsNil() {
+			continue
+		}
+		dst.Field(f.index).Set(v)
+		c.sources[f.name] = source(f.name)
+	}
+}
+
+// apply copies every field that is set in other onto c.
+func (c *serverConfig) apply(other *serverConfig) {
+	if other == nil {
+		return
+	}
+	dst := reflect.ValueOf(c).Elem()
+	src := reflect.ValueOf(other).Elem()
+	for _, f := range configFields {
+		if v := src.Field(f.index); !v.IsNil() {
+			dst.Field(f.index).Set(v)
+		}
+	}
+}
+
+// loadEnvConfig reads the HELLO_* variables from environ into a config. Fields
+// without a variable are left unset.
+func loadEnvConfig(environ []string) (*serverConfig, error) {
+	vars := make(map[string]string)
+	for _, kv := range environ {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+			vars[parts[0]] = parts[1]
+		}
+	}
+
+	var cfg serverConfig
+	for _, f := range configFields {
+		name := envPrefix + strings.ToUpper(f.name)
+		raw, ok := vars[name]
+		if !ok {
+			continue
+		}
+		if err := f.set(&cfg, raw); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// fieldFlag is a flag.Value that sets a config field.
+type fieldFlag struct {
+	cfg   *serverConfig
+	field configField
+}
+
+func (f *fieldFlag) String() string {
+	if f.cfg == nil {
+		return ""
+	}
+	if v := f.field.get(f.cfg); v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func (f *fieldFlag) Set(raw string) error {
+	return f.field.set(f.cfg, raw)
+}
+
+func (f *fieldFlag) IsBoolFlag() bool {
+	return f.field.typ.Kind() == reflect.Bool
+}
+
+// registerConfigFlags defines a flag for every config field, named after the
+// field with dashes, e.g. -consul-addr. Values given on the command line are
+// stored in the returned config; fields without a flag are left unset.
+func registerConfigFlags(fs *flag.FlagSet) *serverConfig {
+	cfg := &serverConfig{}
+	for _, f := range configFields {
+		name := strings.ReplaceAll(f.name, "_", "-")
+		fs.Var(&fieldFlag{cfg: cfg, field: f}, name, fmt.Sprintf("Set the '%s' config field.", f.name))
+	}
+	return cfg
+}
+
+// configLayers holds the layers the effective config is built from.
+type configLayers struct {
+	defaults *serverConfig
+	file     *serverConfig
+	env      *serverConfig
+	flags    *serverConfig
+
+	// runtime holds values set while running, from Consul KV or the HTTP API.
+	// runtimeSources records which of the two set each field.
+	runtime        *serverConfig
+	runtimeSources map[string]string
+}
+
+// newConfigLayers loads every layer below the runtime one.
+func newConfigLayers(cfgFile string, flags *serverConfig) (configLayers, error) {
+	l := configLayers{
+		defaults:       defaultConfig(),
+		flags:          flags,
+		runtime:        &serverConfig{},
+		runtimeSources: make(map[string]string),
+	}
+
+	var err error
+	if l.env, err = loadEnvConfig(os.Environ()); err != nil {
+		return l, fmt.Errorf("failed to load config from environment: %v", err)
+	}
+	if l.file, err = loadConfigFile(cfgFile); err != nil {
+		return l, err
+	}
+	return l, nil
+}
+
+// loadConfigFile loads the config file layer at startup. A missing file is
+// only logged so that the service can run without one.
+func loadConfigFile(cfgFile string) (*serverConfig, error) {
+	cfg, err := loadConfig(cfgFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		logger("config").Warn("config file does not exist, skipping it", "file", cfgFile)
+		return nil, nil
+	}
+	return cfg, err
+}
+
+// build stacks the layers into a validated config that records the source of
+// every field.
+func (l configLayers) build() (*serverConfig, error) {
+	cfg := &serverConfig{sources: make(map[string]string)}
+
+	for _, layer := range []struct {
+		cfg    *serverConfig
+		source string
+	}{
+		{l.defaults, sourceDefault},
+		{l.file, sourceFile},
+		{l.env, sourceEnv},
+		{l.flags, sourceFlag},
+	} {
+		source := layer.source
+		cfg.overlay(layer.cfg, func(string) string { return source })
+	}
+	cfg.overlay(l.runtime, func(name string) string { return l.runtimeSources[name] })
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return cfg, nil
+}
+
+// withRuntime returns a copy of the layers whose runtime layer can be
+// modified without affecting l.
+func (l configLayers) withRuntime() configLayers {
+	l.runtime = l.runtime.clone()
+
+	sources := make(map[string]string, len(l.runtimeSources))
+	for k, v := range l.runtimeSources {
+		sources[k] = v
+	}
+	l.runtimeSources = sources
+	return l
+}
+
+// fieldChange describes a field whose effective value changed.
+type fieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+func (c fieldChange) String() string {
+	return fmt.Sprintf("%s changed from %s to %s", c.Field, formatValue(c.Old), formatValue(c.New))
+}
+
+// formatValue renders a field value for logs. Unset fields are shown as
+// "unset".
+func formatValue(v interface{}) string {
+	if v == nil {
+		return "unset"
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// diffConfig returns the fields whose values differ between old and new.
+func diffConfig(old, new *serverConfig) []fieldChange {
+	changes := make([]fieldChange, 0)
+	for _, f := range configFields {
+		o, n := f.get(old), f.get(new)
+		if !reflect.DeepEqual(o, n) {
+			changes = append(changes, fieldChange{Field: f.name, Old: o, New: n})
+		}
+	}
+	return changes
+}
+
+// provenance describes the effective value of a field and where it came from.
+type provenance struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// provenance returns the value and source of every set field in c.
+func (c *serverConfig) provenance() map[string]provenance {
+	out := make(map[string]provenance)
+	for _, f := range configFields {
+		if v := f.get(c); v != nil {
+			out[f.name] = provenance{Value: v, Source: c.sources[f.name]}
+		}
+	}
+	return out
+}
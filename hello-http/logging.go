@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Log formats, see setupLogging.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// requestIDHeader carries the ID of an HTTP request, taken from the client
+// when it sends one.
+const requestIDHeader = "X-Request-Id"
+
+// logLevel is the level of the default logger, changed live by applyLogLevel.
+var logLevel = new(slog.LevelVar)
+
+// setupLogging makes the default logger write format to stderr at logLevel.
+// The standard log package writes through it too.
+func setupLogging(format string) error {
+	opts := slog.HandlerOptions{Level: logLevel}
+
+	var handler slog.Handler
+	switch format {
+	case logFormatText:
+		handler = slog.NewTextHandler(os.Stderr, &opts)
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, &opts)
+	default:
+		return fmt.Errorf("unknown log format '%s', must be '%s' or '%s'", format, logFormatText, logFormatJSON)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// parseLogLevel parses a level such as "info" or "debug".
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown level '%s'", s)
+	}
+	return level, nil
+}
+
+// applyLogLevel sets the log level from log_level, lowered to debug while
+// debug_mode is enabled.
+func applyLogLevel(cfg *serverConfig) {
+	level, err := parseLogLevel(StringVal(cfg.LogLevel))
+	if err != nil {
+		// Rejected by validate
+		level = slog.LevelInfo
+	}
+	if BoolVal(cfg.DebugMode) {
+		level = slog.LevelDebug
+	}
+	if level != logLevel.Level() {
+		logLevel.Set(level)
+		logger("logging").Info("log level changed", "level", strings.ToLower(level.String()))
+	}
+}
+
+// logger returns the default logger for component.
+func logger(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
+
+// fatal logs msg as an error and exits.
+func fatal(component, msg string, args ...any) {
+	logger(component).Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+
+// withRequestID tags the request with the ID sent by the client, or a new
+// one, and echoes it in the response.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// requestLogger returns the logger for component with the ID of request r.
+func requestLogger(r *http.Request, component string) *slog.Logger {
+	l := logger(component)
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		l = l.With("request_id", id)
+	}
+	return l
+}
+
+// stdLogger returns a standard logger writing through the default logger at
+// level, for libraries such as net/http.
+func stdLogger(component string, level slog.Level) *log.Logger {
+	return slog.NewLogLogger(logger(component).Handler(), level)
+}
@@ -2,24 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	hellov1 "github.com/freddygv/consul-getting-started/hello-http/proto/hello/v1"
 	"github.com/matryer/way"
 	"github.com/prometheus/client_golang/prometheus"
-"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
-	"log"
+	"google.golang.org/grpc/reflection"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -33,196 +40,621 @@ const (
 	defaultCfg     = "config.json"
 )
 
-var (
-	httpReqs = prometheus.NewCounter(
-    prometheus.CounterOpts{
-        Name: "http_requests_total",
-        Help: "Count of HTTP requests processed.",
-    })
-)
-
-func init() {
-	prometheus.MustRegister(httpReqs)
-}
-
 func main() {
 	var (
-		httpAddr   = flag.String("addr", defaultAddr, "Hello service address.")
-		configFile = flag.String("cfg-file", defaultCfg, "Path to config file.")
+		httpAddr       = flag.String("addr", defaultAddr, "Hello service address.")
+		healthAddr     = flag.String("health-addr", "", "Optional address serving the health endpoint over plain HTTP. Required to register the service when clients must present certificates.")
+		grpcAddr       = flag.String("grpc-addr", gRPCPort, "Address of the gRPC server, serving the Greeter and health check services.")
+		connectService = flag.String("connect-service", "", "Serve as this Connect-native service using certificates from the Consul agent.")
+		metricsAddr    = flag.String("metrics-addr", prometheusPort, "Address serving the Prometheus metrics.")
+		metricsPath    = flag.String("metrics-path", "/metrics", "Path of the Prometheus metrics.")
+		configFile     = flag.String("cfg-file", defaultCfg, "Path to config file.")
+		cfgTemplate    = flag.String("cfg-template", "", "Path to a config template to render into the config file using data from Consul.")
+		watchCfgFile   = flag.Bool("watch-cfg-file", true, "Reload the config when the config file changes.")
+		validateConfig = flag.Bool("validate-config", false, "Validate the config file and exit.")
+		scrapeConfig   = flag.Bool("scrape-config", false, "Print an example Prometheus scrape config discovering the service through Consul and exit.")
+		consulToken    = flag.String("consul-token", "", "ACL token for Consul requests. Defaults to CONSUL_HTTP_TOKEN.")
+		tokenFile      = flag.String("consul-token-file", "", "File holding the ACL token for Consul requests, read again when it changes. Defaults to CONSUL_HTTP_TOKEN_FILE.")
+		logFormat      = flag.String("log-format", logFormatText, "Format of the logs, 'text' or 'json'.")
+		flagConfig     = registerConfigFlags(flag.CommandLine)
 	)
 	flag.Parse()
 
-	log.Printf("[INFO] Starting server...")
+	if err := setupLogging(StringVal(logFormat)); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -log-format: %v\n", err)
+		os.Exit(1)
+	}
+	if BoolVal(validateConfig) {
+		if err := checkConfigFile(StringVal(configFile), flagConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "Config file '%s' is invalid: %v\n", StringVal(configFile), err)
+			os.Exit(1)
+		}
+		fmt.Printf("Config file '%s' is valid\n", StringVal(configFile))
+		return
+	}
+	if BoolVal(scrapeConfig) {
+		if err := writeScrapeConfig(os.Stdout, StringVal(configFile), flagConfig, StringVal(metricsPath)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to generate scrape config: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	logger("main").Info("starting server")
 
-	s := newServer(*configFile)
+	s := newServer(StringVal(configFile), flagConfig)
+	s.token = newConsulToken(StringVal(consulToken), StringVal(tokenFile))
+	prometheus.MustRegister(serverCollector{s: s})
+	s.metricsAddr, s.metricsPath = StringVal(metricsAddr), StringVal(metricsPath)
+	s.healthAddr = StringVal(healthAddr)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	for _, key := range SliceVal(s.cfg.ToWatch) {
-		log.Printf("[INFO] Running watch for key '%s'", key)
+	if tmplFile := StringVal(cfgTemplate); tmplFile != "" {
+		tr, err := newTemplateRenderer(s, tmplFile, StringVal(configFile), limiterRate, limiterBurst)
+		if err != nil {
+			fatal("template", "failed to load template", "error", err)
+		}
+		logger("template").Info("rendering config template", "template", tmplFile, "file", StringVal(configFile))
+		err = tr.renderAndReload(ctx)
+		go tr.run(ctx, err)
+	}
+
+	cfg := s.config()
+	if len(SliceVal(cfg.AuthMethods)) == 0 {
+		logger("auth").Warn("no auth_methods configured, health and admin endpoints are open to anyone")
+	}
+	for _, key := range SliceVal(cfg.ToWatch) {
+		if _, ok := lookupKVField(key, StringVal(cfg.ServiceName)); !ok {
+			logger("watch").Warn("values will be ignored", "key", key, "error", errUnknownKey)
+		}
+		logger("watch").Info("running watch", "key", key)
 		go s.watchKV(ctx, key, limiterRate, limiterBurst)
 	}
 
-	go s.captureReload(ctx, StringVal(configFile))
+	if svc := StringVal(connectService); svc != "" {
+		if StringVal(cfg.TLSCertFile) != "" {
+			fatal("connect", "-connect-service cannot be combined with tls_cert_file")
+		}
+		connect, err := newConnectTLS(ctx, s, svc)
+		if err != nil {
+			fatal("connect", "failed to set up Connect", "error", err)
+		}
+		s.connect = connect
+		go s.connect.watch(ctx)
+	} else if StringVal(cfg.TLSCertFile) != "" {
+		certs, err := newCertReloader(s)
+		if err != nil {
+			fatal("tls", "failed to set up HTTPS", "error", err)
+		}
+		s.certs = certs
+		go s.certs.watch(ctx)
+	}
+	if s.requiresClientCerts() && BoolVal(cfg.RegisterService) && s.healthAddr == "" {
+		// The agent presents no client certificate, so its check would never pass
+		fatal("registration", "client certificates are required, set -health-addr to serve the health check over plain HTTP")
+	}
+
+	go s.captureReload(ctx)
+	s.checks.run(ctx)
+	go s.runWatchdog(ctx)
 
-	log.Printf("[INFO] gRPC health check listening on '%s'...", gRPCPort)
-	go s.runGRPC(ctx, gRPCPort)
+	port, err := listenPort(StringVal(httpAddr))
+	if err != nil {
+		fatal("registration", "invalid listen address", "error", err)
+	}
+	deregistered := make(chan struct{})
+	go func() {
+		s.runRegistration(ctx, port)
+		close(deregistered)
+	}()
+	go s.captureShutdown(cancel, deregistered)
 
-	log.Printf("[INFO] Exposing Prometheus metrics on '%s'...", prometheusPort)
-	go s.runPrometheus(prometheusPort)
+	go s.mirrorAudit(ctx)
+	if BoolVal(watchCfgFile) {
+		go s.watchConfigFile(ctx)
+	}
 
-	log.Printf("[INFO] Hello service with HTTP check listening on %s", StringVal(httpAddr))
-	log.Fatal(http.ListenAndServe(StringVal(httpAddr), s.router))
+	logger("grpc").Info("Greeter and health check listening", "addr", StringVal(grpcAddr))
+	go s.runGRPC(ctx, StringVal(grpcAddr))
+
+	logger("metrics").Info("exposing Prometheus metrics", "addr", StringVal(metricsAddr), "path", StringVal(metricsPath))
+	go s.runPrometheus(StringVal(metricsAddr), StringVal(metricsPath))
+
+	if addr := StringVal(healthAddr); addr != "" {
+		logger("health").Info("health endpoint listening", "addr", addr)
+		go s.runHealthListener(addr)
+	}
+
+	logger("main").Info("hello service with HTTP check listening", "addr", StringVal(httpAddr))
+	s.started.Store(true)
+	if s.connect != nil {
+		err = s.connect.listenAndServe(StringVal(httpAddr))
+	} else {
+		err = s.listenAndServe(StringVal(httpAddr))
+	}
+	if err != http.ErrServerClosed {
+		fatal("http", "failed to serve", "error", err)
+	}
+	<-s.life.done
 }
 
 type server struct {
 	router *way.Router
-	cfg    *serverConfig
+
+	// cfg holds the current config snapshot. Snapshots are never modified
+	// once published, so readers can use them without locking.
+	cfg atomic.Pointer[serverConfig]
+
+	// mu serializes updates to cfg and guards the fields below.
+	mu      sync.Mutex
+	cfgFile string
+	layers  configLayers
+
+	audit *auditLog
+	auth  *authState
+
+	// token is the ACL token sent to Consul, denied holds the endpoints that
+	// rejected it as "METHOD path" keys.
+	token  *consulToken
+	denied sync.Map
+
+	// synced holds the time each watched key was last synced from Consul.
+	synced sync.Map
+
+	// configChanged is notified after every config change.
+	configChanged broadcast
+
+	// started is set once the servers are started, and watchdog holds the
+	// time the watchdog last took mu, in Unix nanoseconds.
+	started  atomic.Bool
+	watchdog atomic.Int64
+
+	// checks runs the health checks, and health aggregates them into the
+	// status served by /healthz and the gRPC health checks.
+	checks *healthRegistry
+	health healthEvaluator
+
+	consul *consulAgents
+
+	// healthAddr is the address of the plain HTTP health listener, if any.
+	healthAddr string
+
+	// metricsAddr and metricsPath locate the Prometheus metrics, advertised
+	// in the service meta.
+	metricsAddr string
+	metricsPath string
+
+	life *lifecycle
+
+	// grpcHealth serves the gRPC health checks.
+	grpcHealth *health.Server
+
+	// certs is nil unless HTTPS is enabled.
+	certs *certReloader
+	// connect is nil unless running as a Connect-native service.
+	connect *connectTLS
 }
 
-func newServer(cfgFile string) *server {
-	config, err := loadConfig(cfgFile)
+func newServer(cfgFile string, flags *serverConfig) *server {
+	layers, err := newConfigLayers(cfgFile, flags)
+	if err != nil {
+		fatal("config", "failed to load config", "error", err)
+	}
+	config, err := layers.build()
 	if err != nil {
-		log.Printf("[WARN] failed to load config from file '%s', using default. err: %v", cfgFile, err)
+		fatal("config", "failed to load config", "error", err)
 	}
-	config = config.merge(defaultConfig())
 
 	s := server{
-		router: way.NewRouter(),
-		cfg:    config,
-	}
+		router:  way.NewRouter(),
+		cfgFile: cfgFile,
+		layers:  layers,
+		audit:   newAuditLog(auditLogSize),
+		life:    newLifecycle(),
 
-	s.router.HandleFunc("GET", "/hello", s.handleHello())
-	s.router.HandleFunc("GET", "/healthz", s.handleHealth())
-	s.router.HandleFunc("PUT", "/health/pass", s.enableHealth())
-	s.router.HandleFunc("PUT", "/health/fail", s.disableHealth())
+		grpcHealth: health.NewServer(),
+	}
+	if s.consul, err = newConsulAgents(); err != nil {
+		fatal("consul", "failed to configure Consul client", "error", err)
+	}
+	s.auth = newAuthState(&s)
+	s.cfg.Store(config)
+	applyLogLevel(config)
+
+	s.watchdog.Store(time.Now().UnixNano())
+	s.checks = newHealthRegistry(s.onCheckResult)
+	s.health = aggregateHealth{s: &s}
+	s.registerBuiltinChecks()
+	s.syncHTTPChecks(config)
+
+	s.handle("GET", "/hello", s.handleHello())
+	s.handle("GET", "/livez", s.handleLivez())
+	s.handle("GET", "/readyz", s.handleReadyz())
+	s.handle("GET", "/startupz", s.handleStartupz())
+	s.handle("GET", "/healthz", s.handleHealth())
+	s.handle("PUT", "/health/pass", s.requireAuth(s.enableHealth()))
+	s.handle("PUT", "/health/fail", s.requireAuth(s.disableHealth()))
+	s.handle("GET", "/admin/config", s.requireAuth(s.handleGetConfig()))
+	s.handle("PATCH", "/admin/config", s.requireAuth(s.handlePatchConfig()))
+	s.handle("POST", "/admin/config/persist", s.requireAuth(s.handlePersistConfig()))
+	s.handle("GET", "/admin/config/provenance", s.requireAuth(s.handleProvenance()))
+	s.handle("POST", "/admin/reload", s.requireAuth(s.handleReload()))
+	s.handle("GET", "/admin/audit", s.requireAuth(s.handleAudit()))
 
 	return &s
 }
 
+// config returns the current config snapshot. It must not be modified.
+func (s *server) config() *serverConfig {
+	return s.cfg.Load()
+}
+
+// update applies fn to a copy of the runtime config layer, then rebuilds and
+// publishes the config. Fields changed by fn are attributed to source, and
+// trigger and caller are recorded in the audit log. Updates are serialized,
+// and nothing is published if fn returns an error or the resulting config is
+// invalid.
+func (s *server) update(source, trigger, caller string, fn func(c *serverConfig) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	layers := s.layers.withRuntime()
+	if err := fn(layers.runtime); err != nil {
+		return err
+	}
+	for _, f := range configFields {
+		switch v := f.get(layers.runtime); {
+		case v == nil:
+			delete(layers.runtimeSources, f.name)
+		case !reflect.DeepEqual(v, f.get(s.layers.runtime)):
+			layers.runtimeSources[f.name] = source
+		}
+	}
+	_, err := s.publish(layers, trigger, caller)
+	return err
+}
+
+// reload re-reads the config file layer, then rebuilds and publishes the
+// config. The running config is kept if the file is missing or invalid.
+// Unlike at startup, a missing file is an error, so that deleting it does not
+// silently revert the service to the defaults.
+func (s *server) reload(trigger, caller string) ([]fieldChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := loadConfig(s.cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	layers := s.layers
+	layers.file = file
+	return s.publish(layers, trigger, caller)
+}
+
+// reloadFrom reloads the config and logs the outcome along with the fields
+// that changed. trigger names what caused the reload, and caller who asked for
+// it, if anyone.
+func (s *server) reloadFrom(trigger, caller string) ([]fieldChange, error) {
+	changes, err := s.reload(trigger, caller)
+	configReloads.WithLabelValues(trigger, result(err)).Inc()
+	if err != nil {
+		logger("config").Error("failed to reload config, keeping running config", "trigger", trigger, "error", err)
+		return nil, err
+	}
+
+	logger("config").Info("config reloaded", "trigger", trigger, "file", s.cfgFile, "changed", len(changes))
+	for _, c := range changes {
+		logger("config").Info("field changed", "trigger", trigger, "change", c.String())
+	}
+	return changes, nil
+}
+
+// publish builds the config from layers and stores both. The fields that
+// changed are recorded in the audit log under trigger and caller, and
+// returned. s.mu must be held.
+func (s *server) publish(layers configLayers, trigger, caller string) ([]fieldChange, error) {
+	config, err := layers.build()
+	if err != nil {
+		return nil, err
+	}
+	changes := diffConfig(s.cfg.Load(), config)
+	s.audit.record(trigger, caller, changes)
+
+	s.layers = layers
+	s.cfg.Store(config)
+	if len(changes) > 0 {
+		applyLogLevel(config)
+		s.syncHTTPChecks(config)
+		s.healthChanged()
+		s.configChanged.notify()
+	}
+	return changes, nil
+}
+
+// checkConfigFile loads and validates a config file without starting the
+// service. Unlike at startup, the file must exist.
+func checkConfigFile(cfgFile string, flags *serverConfig) error {
+	if _, err := loadConfig(cfgFile); err != nil {
+		return err
+	}
+	layers, err := newConfigLayers(cfgFile, flags)
+	if err != nil {
+		return err
+	}
+	_, err = layers.build()
+	return err
+}
+
 // Reload config from file on HUP
-func (s *server) captureReload(ctx context.Context, cfgFile string) {
+func (s *server) captureReload(ctx context.Context) {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGHUP)
 
 	for {
 		select {
 		case sig := <-sigCh:
-			log.Printf("[INFO] captured signal: %v. reloading config...", sig)
-			config, err := loadConfig(cfgFile)
-			if err != nil {
-				log.Printf("[WARN] failed to load config from file '%s', using default. err: %v", cfgFile, err)
-			}
-			s.cfg.mu.Lock()
-			{
-				s.cfg = config.merge(s.cfg)
+			logger("config").Info("captured signal, reloading config", "signal", sig.String())
+			s.reloadFrom(triggerSignal, "")
+			if s.certs != nil {
+				if err := s.certs.reload(); err != nil {
+					logger("tls").Error("failed to reload certificate, keeping current one", "error", err)
+				}
 			}
-			s.cfg.mu.Unlock()
 		}
 	}
 }
 
-func (s *server) runPrometheus(addr string) {
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(addr, nil)
+// checkDefinitions returns the HTTP check registered with the service. It
+// targets the plain health listener when there is one, since the agent cannot
+// present a client certificate.
+func (s *server) checkDefinitions(cfg *serverConfig, svc agentService) []agentCheck {
+	host := svc.Address
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	scheme, port := "http", svc.Port
+	if s.healthAddr != "" {
+		if p, err := listenPort(s.healthAddr); err == nil {
+			port = p
+		}
+	} else if s.certs != nil || s.connect != nil {
+		scheme = "https"
+	}
+
+	return []agentCheck{{
+		CheckID:       svc.ID,
+		Name:          fmt.Sprintf("HTTP API on port %d", port),
+		HTTP:          fmt.Sprintf("%s://%s/healthz", scheme, net.JoinHostPort(host, strconv.Itoa(port))),
+		Method:        "GET",
+		TLSSkipVerify: scheme == "https",
+		Interval:      StringVal(cfg.CheckInterval),
+	}}
+}
+
+// requiresClientCerts reports whether the service only accepts clients that
+// present a certificate, either as a Connect-native service or with HTTPS and
+// tls_ca_file.
+func (s *server) requiresClientCerts() bool {
+	return s.connect != nil || (s.certs != nil && StringVal(s.config().TLSCAFile) != "")
+}
+
+// failHealth fails the gRPC health checks for good. /healthz fails on its own
+// once the service is draining.
+func (s *server) failHealth() {
+	s.grpcHealth.Shutdown()
+}
+
+// runHealthListener serves the health endpoint over plain HTTP, for checks
+// that cannot use TLS.
+func (s *server) runHealthListener(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", instrument("/healthz", s.handleHealth()))
+	mux.HandleFunc("/livez", instrument("/livez", s.handleLivez()))
+	mux.HandleFunc("/readyz", instrument("/readyz", s.handleReadyz()))
+	mux.HandleFunc("/startupz", instrument("/startupz", s.handleStartupz()))
+	srv := http.Server{Addr: addr, Handler: mux}
+	s.life.onStop("health", srv.Shutdown)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		fatal("health", "failed to serve health endpoint", "error", err)
+	}
+}
+
+// runPrometheus serves the Prometheus metrics at path on addr.
+func (s *server) runPrometheus(addr, path string) {
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.Handler())
+	srv := http.Server{Addr: addr, Handler: mux}
+	s.life.onStop("metrics", srv.Shutdown)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logger("metrics").Error("failed to serve metrics", "error", err)
+	}
 }
 
-// Run a gRPC server exclusively for health checking
+// Run a gRPC server for the Greeter service and health checking, with server
+// reflection. It uses the same TLS as the HTTP server, if any. The serving
+// status of the service, and the overall server status (empty service name),
+// follow the health of the service as it changes. The server stops when ctx
+// is done.
 func (s *server) runGRPC(ctx context.Context, addr string) {
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatalf("[ERR] grpc health: %v", addr, err)
+		fatal("grpc", "failed to listen", "addr", addr, "error", err)
 	}
 
-	gs := grpc.NewServer()
-	server := health.NewServer()
-	grpc_health_v1.RegisterHealthServer(gs, server)
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(unaryMetrics), grpc.StreamInterceptor(streamMetrics)}
+	if cfg := s.grpcTLSConfig(); cfg != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(cfg)))
+	}
+	gs := grpc.NewServer(opts...)
+	hello := &greeter{s: s, stopping: make(chan struct{})}
+	hellov1.RegisterGreeterServer(gs, hello)
+	grpc_health_v1.RegisterHealthServer(gs, s.grpcHealth)
+	reflection.Register(gs)
+
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() {
+			close(hello.stopping)
+			gs.GracefulStop()
+		})
+	}
+	s.life.onStop("grpc", func(ctx context.Context) error {
+		stopped := make(chan struct{})
+		go func() {
+			stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			return nil
+		case <-ctx.Done():
+			gs.Stop()
+			return ctx.Err()
+		}
+	})
 
-	svcName := strings.TrimSuffix(StringVal(s.cfg.ServiceName), "/")
+	changed := s.checks.changed.subscribe()
 	go func() {
+		var svcName string
+		status := grpc_health_v1.HealthCheckResponse_UNKNOWN
 		for {
+			svcName, status = s.setGRPCHealth(svcName, status)
+
 			select {
 			case <-ctx.Done():
+				stop()
 				return
-			default:
-				var enableChecks bool
-				s.cfg.mu.RLock()
-				{
-					enableChecks = BoolVal(s.cfg.EnableChecks)
-				}
-				s.cfg.mu.RUnlock()
-
-				switch enableChecks {
-				case true:
-					server.SetServingStatus(svcName, grpc_health_v1.HealthCheckResponse_SERVING)
-				case false:
-					server.SetServingStatus(svcName, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
-				}
-				time.Sleep(2 * time.Second)
+			case <-changed:
 			}
 		}
 	}()
 
 	if err := gs.Serve(lis); err != nil {
-		log.Fatalf("[ERR] grpc health: failed to serve: %v", err)
+		fatal("grpc", "failed to serve", "error", err)
+	}
+}
+
+// grpcTLSConfig returns the TLS config of the HTTP server for gRPC, or nil
+// when the service is served in plaintext. Clients must present the same
+// certificates as for HTTP, and HTTP/2 is negotiated with ALPN as gRPC
+// requires.
+func (s *server) grpcTLSConfig() *tls.Config {
+	var cfg *tls.Config
+	switch {
+	case s.connect != nil:
+		cfg = s.connect.tlsConfig()
+	case s.certs != nil:
+		cfg = s.certs.tlsConfig()
+	default:
+		return nil
+	}
+
+	getConfig := cfg.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		c, err := getConfig(hello)
+		if err != nil {
+			return nil, err
+		}
+		c.NextProtos = []string{"h2"}
+		return c, nil
 	}
+	return cfg
+}
+
+// setGRPCHealth serves the gRPC health checks unless the service is critical.
+// The status is only set when it differs from the last one set, given by
+// svcName and status, so that Watch streams see no redundant updates. It
+// returns the service name and status now set.
+func (s *server) setGRPCHealth(svcName string, status grpc_health_v1.HealthCheckResponse_ServingStatus) (string, grpc_health_v1.HealthCheckResponse_ServingStatus) {
+	name := strings.TrimSuffix(StringVal(s.config().ServiceName), "/")
+	next := grpc_health_v1.HealthCheckResponse_SERVING
+	if s.health.evaluate().Status == statusCritical {
+		next = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	if name == svcName && next == status {
+		return svcName, status
+	}
+
+	s.grpcHealth.SetServingStatus(name, next)
+	s.grpcHealth.SetServingStatus("", next)
+	logger("grpc").Info("health status changed", "service", name, "status", next.String())
+	return name, next
+}
+
+// greetings maps each supported language to its greeting.
+var greetings = map[string]string{
+	"english":    "Hello World",
+	"french":     "Bonjour Monde",
+	"portuguese": "Olá Mundo",
+	"spanish":    "Hola Mundo",
 }
 
 func (s *server) handleHello() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		s.cfg.mu.RLock()
-		defer s.cfg.mu.RUnlock()
-
-		switch StringVal(s.cfg.Language) {
-		case "french":
-			fmt.Fprintln(w, "Bonjour Monde")
-		case "portuguese":
-			fmt.Fprintln(w, "Olá Mundo")
-		case "spanish":
-			fmt.Fprintln(w, "Hola Mundo")
-		default:
-			fmt.Fprintln(w, "Hello World")
+		if id := peerIdentity(r); id != "" {
+			requestLogger(r, "hello").Info("request from peer", "peer", id)
 		}
-		httpReqs.Inc()
+
+		greeting, _ := s.greeting()
+		fmt.Fprintln(w, greeting)
 	}
 }
 
+// greeting returns the greeting in the configured language, falling back to
+// english, and the language it is in.
+func (s *server) greeting() (string, string) {
+	lang := StringVal(s.config().Language)
+	greeting, ok := greetings[lang]
+	if !ok {
+		lang = "english"
+		greeting = greetings[lang]
+	}
+	return greeting, lang
+}
+
+// handleHealth reports the aggregate health along with the result of every
+// check. As Consul HTTP checks expect, warning is served as 429 and critical
+// as 503. A service that is not ready, such as one with checks disabled or
+// draining before shutdown, is served as 410 as it always has been.
 func (s *server) handleHealth() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		s.cfg.mu.RLock()
-		defer s.cfg.mu.RUnlock()
+	type response struct {
+		healthResult
+		Checks []checkResult `json:"checks"`
+	}
 
-		// Fail check if checks aren't enabled
-		if !BoolVal(s.cfg.EnableChecks) {
-			w.WriteHeader(http.StatusGone)
-			return
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := s.health.evaluate()
+		code := http.StatusOK
+		if ok, _ := s.ready(); !ok {
+			code = http.StatusGone
+		} else if res.Status == statusWarning {
+			code = http.StatusTooManyRequests
+		} else if res.Status == statusCritical {
+			code = http.StatusServiceUnavailable
 		}
-
-		fmt.Fprintln(w, "I'm alive")
-		httpReqs.Inc()
+		writeJSON(w, code, response{healthResult: res, Checks: s.checks.list()})
 	}
 }
 
 func (s *server) disableHealth() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		s.cfg.mu.Lock()
-		defer s.cfg.mu.Unlock()
-
-		s.cfg.EnableChecks = BoolPtr(false)
+		s.update(sourceHTTP, triggerHTTP, requestCaller(r), func(c *serverConfig) error {
+			c.EnableChecks = BoolPtr(false)
+			return nil
+		})
 		fmt.Fprintln(w, "Health endpoint disabled.")
-		httpReqs.Inc()
 	}
 }
 
 func (s *server) enableHealth() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		s.cfg.mu.Lock()
-		defer s.cfg.mu.Unlock()
-
-		s.cfg.EnableChecks = BoolPtr(true)
+		s.update(sourceHTTP, triggerHTTP, requestCaller(r), func(c *serverConfig) error {
+			c.EnableChecks = BoolPtr(true)
+			return nil
+		})
 		fmt.Fprintln(w, "Health endpoint enabled.")
-		httpReqs.Inc()
 	}
 }
 
@@ -237,91 +669,84 @@ func (s *server) watchKV(ctx context.Context, key string, limit rate.Limit, burs
 
 	for {
 		// Wait until limiter allows request to happen
-		if err := limiter.Wait(context.Background()); err != nil {
-			log.Printf("[ERR] watch '%s': failed to wait for limiter", key)
+		if err := limiter.Wait(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger("watch").Error("failed to wait for limiter", "key", key)
 			continue
 		}
 
 		// Make blocking query to watch key
-		target := fmt.Sprintf("%s%s%s?index=%d", StringVal(s.cfg.ConsulAddr), StringVal(s.cfg.KVPath), key, index)
-		resp, err := http.Get(target)
+		cfg := s.config()
+		resp, err := s.consulGet(ctx, StringVal(cfg.KVPath)+key, index)
+		if ctx.Err() != nil {
+			return
+		}
+		kvWatchIterations.WithLabelValues(key).Inc()
 		if err != nil {
-			log.Printf("[ERR] watch '%s': failed to get '%s': %v", key, target, err)
+			kvWatchErrors.WithLabelValues(key).Inc()
+			// Denials are logged once and counted by consulDo
+			if !errors.Is(err, errACLDenied) {
+				logger("watch").Error("watch failed", "key", key, "error", err)
+			}
 			continue
 		}
 
-		// Parse the raft index for this key (X-Consul-Index)
-		header := resp.Header
-		indexStr := header.Get("X-Consul-Index")
-		if indexStr != "" {
-			index, err = strconv.ParseUint(indexStr, 10, 64)
-			if err != nil {
-				log.Printf("[ERR] watch '%s': failed to parse X-Consul-Index: %v", key, err)
-				continue
-			}
+		// Raft index for this key (X-Consul-Index)
+		if resp.Index != 0 {
+			index = resp.Index
 		}
 		// Reset if it goes backwards or is 0
 		// See: https://www.consul.io/api/features/blocking.html#implementation-details
 		if index < lastIndex || index == 0 {
+			logger("watch").Debug("index went backwards, resetting", "key", key, "index", lastIndex, "new_index", index)
 			index = 1
 			lastIndex = 1
 
 			// TODO: Continuing implies we don't trust the data on the server
 			continue
 		}
+		if index != lastIndex {
+			logger("watch").Debug("index changed", "key", key, "index", lastIndex, "new_index", index)
+		}
 		lastIndex = index
+		if _, synced := s.synced.Swap(key, time.Now()); !synced {
+			// The first sync may make the service ready
+			s.healthChanged()
+		}
 
 		data := make([]keyResponse, 0)
-		json.NewDecoder(resp.Body).Decode(&data)
-		resp.Body.Close()
+		json.Unmarshal(resp.Body, &data)
 
 		// Key might not exist yet
 		if len(data) == 0 {
-			log.Printf("[WARN] watch '%s': empty response, key does not exist", key)
+			logger("watch").Warn("empty response, key does not exist", "key", key)
 			continue
 		}
 
 		// We are not recursing on a key-prefix so these arrays will only return one value
 		decoded, err := base64.StdEncoding.DecodeString(data[0].Value)
 		if err != nil {
-			log.Printf("[ERR] watch '%s': failed to decode value: '%s'", key, data[0].Value)
+			kvWatchErrors.WithLabelValues(key).Inc()
+			logger("watch").Error("failed to decode value", "key", key, "value", data[0].Value)
 			continue
 		}
 		strVal := string(decoded)
 
-		err = nil
-		switch key {
-		case "language":
-			s.setLanguage(strVal)
-		case StringVal(s.cfg.ServiceName) + "enable_checks":
-			err = s.setEnableChecks(strVal)
-		}
-		if err != nil {
-			log.Printf("[ERR] watch '%s': %v", key, err)
+		if err := s.setKV(key, strVal); err != nil {
+			if err == errUnknownKey {
+				logger("watch").Warn("ignoring value", "key", key, "error", err)
+			} else {
+				kvWatchErrors.WithLabelValues(key).Inc()
+				logger("watch").Error("failed to set value", "key", key, "error", err)
+			}
 			continue
 		}
 
-		log.Printf("[INFO] watch '%s': updated to %s", key, strVal)
-	}
-}
-
-func (s *server) setLanguage(lang string) {
-	s.cfg.mu.Lock()
-	defer s.cfg.mu.Unlock()
-
-	s.cfg.Language = StringPtr(lang)
-}
-
-func (s *server) setEnableChecks(val string) error {
-	s.cfg.mu.Lock()
-	defer s.cfg.mu.Unlock()
-
-	parsed, err := strconv.ParseBool(val)
-	if err != nil {
-		return fmt.Errorf("failed to parse enable_checks bool '%s': %v", val, err)
+		kvLastUpdate.WithLabelValues(key).SetToCurrentTime()
+		logger("watch").Info("updated", "key", key, "value", strVal)
 	}
-	s.cfg.EnableChecks = BoolPtr(parsed)
-	return nil
 }
 
 type keyResponse struct {
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// Only log with -v
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a server reading cfg from a JSON config file in a
+// temporary directory.
+func newTestServer(t *testing.T, cfg map[string]interface{}) *server {
+	t.Helper()
+
+	body, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgFile := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(cfgFile, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return newServer(cfgFile, &serverConfig{})
+}
+
+// serve sends a request to the server's router and returns the response.
+func serve(s *server, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+// TestConcurrentConfigChanges changes the config through every path at once
+// while it is read. Run it with -race.
+func TestConcurrentConfigChanges(t *testing.T) {
+	s := newTestServer(t, map[string]interface{}{"language": "french"})
+
+	const iterations = 200
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+
+	write := func(fn func(i int)) {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for i := 0; i < iterations; i++ {
+				fn(i)
+			}
+		}()
+	}
+	write(func(i int) {
+		lang := []string{"english", "spanish"}[i%2]
+		if err := s.setKV("language", lang); err != nil {
+			t.Errorf("setKV: %v", err)
+		}
+	})
+	write(func(i int) {
+		path := []string{"/health/fail", "/health/pass"}[i%2]
+		if w := serve(s, "PUT", path, ""); w.Code != http.StatusOK {
+			t.Errorf("PUT %s: got %d", path, w.Code)
+		}
+	})
+	write(func(i int) {
+		body := []string{`{"language": "portuguese"}`, `{"debug_mode": true}`}[i%2]
+		if w := serve(s, "PATCH", "/admin/config", body); w.Code != http.StatusOK {
+			t.Errorf("PATCH /admin/config: got %d: %s", w.Code, w.Body)
+		}
+	})
+	write(func(int) {
+		if _, err := s.reload(triggerHTTP, ""); err != nil {
+			t.Errorf("reload: %v", err)
+		}
+	})
+
+	read := func(path string, check func(w *httptest.ResponseRecorder)) {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				check(serve(s, "GET", path, ""))
+			}
+		}()
+	}
+	read("/hello", func(w *httptest.ResponseRecorder) {
+		greeting := strings.TrimSpace(w.Body.String())
+		for _, g := range greetings {
+			if greeting == g {
+				return
+			}
+		}
+		t.Errorf("GET /hello: unexpected greeting %q", greeting)
+	})
+	read("/healthz", func(w *httptest.ResponseRecorder) {
+		switch w.Code {
+		case http.StatusOK, http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGone:
+		default:
+			t.Errorf("GET /healthz: unexpected code %d", w.Code)
+		}
+	})
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	// Every change went through the runtime layer, so the last ones win
+	cfg := s.config()
+	if lang := StringVal(cfg.Language); lang != "spanish" && lang != "portuguese" {
+		t.Errorf("got language %q after the updates", lang)
+	}
+	if !BoolVal(cfg.EnableChecks) {
+		t.Error("enable_checks is false after the last /health/pass")
+	}
+}
+
+// TestWatchKVStopsOnCancel checks that watchKV returns once its context is
+// cancelled, whether it is blocked on Consul or waiting for the limiter.
+func TestWatchKVStopsOnCancel(t *testing.T) {
+	tests := []struct {
+		name  string
+		block bool
+	}{
+		{"blocking query", true},
+		{"limiter", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan struct{}, 10)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests <- struct{}{}
+				if tt.block {
+					<-r.Context().Done()
+					return
+				}
+				http.Error(w, "unavailable", http.StatusInternalServerError)
+			}))
+			defer ts.Close()
+			s := newTestServer(t, map[string]interface{}{"consul_addr": ts.URL})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.watchKV(ctx, "language", rate.Every(time.Hour), 1)
+			}()
+
+			select {
+			case <-requests:
+			case <-time.After(5 * time.Second):
+				t.Fatal("watchKV did not query Consul")
+			}
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("watchKV did not return after its context was cancelled")
+			}
+		})
+	}
+}
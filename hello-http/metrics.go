@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Count of HTTP requests processed, by route, method and status code.",
+		},
+		[]string{"route", "method", "code"},
+	)
+	httpDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Latency of HTTP requests, by route and method.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route", "method"},
+	)
+
+	kvWatchIterations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kv_watch_iterations_total",
+			Help: "Count of blocking queries made by the KV watch of each key.",
+		},
+		[]string{"key"},
+	)
+	kvWatchErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kv_watch_errors_total",
+			Help: "Count of failed KV watch iterations for each key.",
+		},
+		[]string{"key"},
+	)
+	kvLastUpdate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kv_watch_last_update_timestamp_seconds",
+			Help: "Time each watched key last updated the config, in Unix seconds.",
+		},
+		[]string{"key"},
+	)
+
+	ttlUpdates = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ttl_updates_total",
+			Help: "Count of TTL check updates sent to Consul, by check and result.",
+		},
+		[]string{"check", "result"},
+	)
+
+	configReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "config_reloads_total",
+			Help: "Count of config reloads, by trigger and result.",
+		},
+		[]string{"trigger", "result"},
+	)
+
+	languageInfoDesc = prometheus.NewDesc(
+		"hello_language_info",
+		"The language greetings are currently in.",
+		[]string{"language"}, nil,
+	)
+	healthStatusDesc = prometheus.NewDesc(
+		"health_status",
+		"Health of the service: 0 passing, 1 warning, 2 critical.",
+		nil, nil,
+	)
+	healthCheckStatusDesc = prometheus.NewDesc(
+		"health_check_status",
+		"Status of each health check: 0 passing, 1 warning, 2 critical.",
+		[]string{"check"}, nil,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, kvWatchIterations, kvWatchErrors, kvLastUpdate,
+		ttlUpdates, configReloads)
+}
+
+// result labels the outcome of an operation in metrics.
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// serverCollector reports the language and health of the server as they are
+// when scraped.
+type serverCollector struct {
+	s *server
+}
+
+func (c serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- languageInfoDesc
+	ch <- healthStatusDesc
+	ch <- healthCheckStatusDesc
+}
+
+func (c serverCollector) Collect(ch chan<- prometheus.Metric) {
+	_, lang := c.s.greeting()
+	ch <- prometheus.MustNewConstMetric(languageInfoDesc, prometheus.GaugeValue, 1, lang)
+
+	res := c.s.health.evaluate()
+	ch <- prometheus.MustNewConstMetric(healthStatusDesc, prometheus.GaugeValue, float64(statusRank[res.Status]))
+	for _, check := range c.s.checks.list() {
+		ch <- prometheus.MustNewConstMetric(healthCheckStatusDesc, prometheus.GaugeValue, float64(statusRank[check.Status]), check.Name)
+	}
+}
+
+// handle registers h with the router for method and pattern, counting and
+// timing its requests under the pattern.
+func (s *server) handle(method, pattern string, h http.HandlerFunc) {
+	s.router.HandleFunc(method, pattern, instrument(pattern, h))
+}
+
+// instrument counts and times the requests served by h under route, and tags
+// them with a request ID for the logs.
+func instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r = withRequestID(w, r)
+		rec := statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(&rec, r)
+
+		requestLogger(r, "http").Debug("request", "route", route, "method", r.Method, "path", r.URL.Path,
+			"code", rec.code, "duration", time.Since(start))
+
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.code)).Inc()
+	}
+}
+
+// statusRecorder records the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// watchdogInterval is how often the watchdog takes the config mutex.
+	watchdogInterval = 5 * time.Second
+
+	// watchdogTimeout is how long the config mutex may go without being
+	// taken by the watchdog before the process is considered wedged.
+	watchdogTimeout = 30 * time.Second
+)
+
+// runWatchdog takes the config mutex every watchdogInterval and records when
+// it last succeeded. A deadlocked mutex leaves the watchdog blocked, which
+// fails /livez once watchdogTimeout has passed.
+func (s *server) runWatchdog(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		s.mu.Unlock()
+		s.watchdog.Store(time.Now().UnixNano())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchdogInterval):
+		}
+	}
+}
+
+// alive reports whether the process is responsive, and why not.
+func (s *server) alive() (bool, string) {
+	last := time.Unix(0, s.watchdog.Load())
+	if since := time.Since(last); since > watchdogTimeout {
+		return false, fmt.Sprintf("Config mutex has not been taken for %s", since.Round(time.Second))
+	}
+	return true, "Process is responsive"
+}
+
+// ready reports whether the service should get traffic, and why not. It
+// requires the watched keys to have been synced from Consul once, checks to
+// be enabled and the service not to be draining.
+func (s *server) ready() (bool, string) {
+	cfg := s.config()
+	switch {
+	case s.life.draining.Load():
+		return false, "Service is draining before shutdown"
+	case !BoolVal(cfg.EnableChecks):
+		return false, fmt.Sprintf("Checks are disabled by enable_checks, set from %s", cfg.sources["enable_checks"])
+	}
+	for _, key := range SliceVal(cfg.ToWatch) {
+		if _, ok := s.synced.Load(key); !ok {
+			return false, fmt.Sprintf("Waiting for the first sync of '%s' from Consul", key)
+		}
+	}
+	return true, "Service is ready"
+}
+
+// handleLivez fails only when the process is wedged, so that it is restarted.
+func (s *server) handleLivez() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, output := s.alive()
+		if !ok {
+			requestLogger(r, "probes").Error("liveness probe failed", "output", output)
+		}
+		writeProbe(w, ok, output)
+	}
+}
+
+// handleReadyz fails while the service should not get traffic. Warnings are
+// ready, only a critical health status is not.
+func (s *server) handleReadyz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := s.health.evaluate()
+		writeProbe(w, res.Status != statusCritical, res.Output)
+	}
+}
+
+// handleStartupz fails until the service has started its servers.
+func (s *server) handleStartupz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.started.Load() {
+			writeProbe(w, false, "Service is starting")
+			return
+		}
+		writeProbe(w, true, "Service has started")
+	}
+}
+
+// writeProbe answers a probe, with 503 when it fails.
+func writeProbe(w http.ResponseWriter, ok bool, output string) {
+	code, status := http.StatusOK, statusPassing
+	if !ok {
+		code, status = http.StatusServiceUnavailable, statusCritical
+	}
+	writeJSON(w, code, healthResult{Status: status, Output: output})
+}
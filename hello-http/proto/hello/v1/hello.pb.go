@@ -0,0 +1,361 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: hello/v1/hello.proto
+
+package hellov1
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type SayHelloRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SayHelloRequest) Reset()         { *m = SayHelloRequest{} }
+func (m *SayHelloRequest) String() string { return proto.CompactTextString(m) }
+func (*SayHelloRequest) ProtoMessage()    {}
+func (*SayHelloRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_5c3dc59179dc9426, []int{0}
+}
+
+func (m *SayHelloRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SayHelloRequest.Unmarshal(m, b)
+}
+func (m *SayHelloRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SayHelloRequest.Marshal(b, m, deterministic)
+}
+func (m *SayHelloRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SayHelloRequest.Merge(m, src)
+}
+func (m *SayHelloRequest) XXX_Size() int {
+	return xxx_messageInfo_SayHelloRequest.Size(m)
+}
+func (m *SayHelloRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SayHelloRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SayHelloRequest proto.InternalMessageInfo
+
+type SayHelloResponse struct {
+	// The greeting, such as "Hello World".
+	Greeting string `protobuf:"bytes,1,opt,name=greeting,proto3" json:"greeting,omitempty"`
+	// The language of the greeting, such as "english".
+	Language             string   `protobuf:"bytes,2,opt,name=language,proto3" json:"language,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SayHelloResponse) Reset()         { *m = SayHelloResponse{} }
+func (m *SayHelloResponse) String() string { return proto.CompactTextString(m) }
+func (*SayHelloResponse) ProtoMessage()    {}
+func (*SayHelloResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_5c3dc59179dc9426, []int{1}
+}
+
+func (m *SayHelloResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SayHelloResponse.Unmarshal(m, b)
+}
+func (m *SayHelloResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SayHelloResponse.Marshal(b, m, deterministic)
+}
+func (m *SayHelloResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SayHelloResponse.Merge(m, src)
+}
+func (m *SayHelloResponse) XXX_Size() int {
+	return xxx_messageInfo_SayHelloResponse.Size(m)
+}
+func (m *SayHelloResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_SayHelloResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SayHelloResponse proto.InternalMessageInfo
+
+func (m *SayHelloResponse) GetGreeting() string {
+	if m != nil {
+		return m.Greeting
+	}
+	return ""
+}
+
+func (m *SayHelloResponse) GetLanguage() string {
+	if m != nil {
+		return m.Language
+	}
+	return ""
+}
+
+type WatchGreetingRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *WatchGreetingRequest) Reset()         { *m = WatchGreetingRequest{} }
+func (m *WatchGreetingRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchGreetingRequest) ProtoMessage()    {}
+func (*WatchGreetingRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_5c3dc59179dc9426, []int{2}
+}
+
+func (m *WatchGreetingRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchGreetingRequest.Unmarshal(m, b)
+}
+func (m *WatchGreetingRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchGreetingRequest.Marshal(b, m, deterministic)
+}
+func (m *WatchGreetingRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchGreetingRequest.Merge(m, src)
+}
+func (m *WatchGreetingRequest) XXX_Size() int {
+	return xxx_messageInfo_WatchGreetingRequest.Size(m)
+}
+func (m *WatchGreetingRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchGreetingRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchGreetingRequest proto.InternalMessageInfo
+
+type WatchGreetingResponse struct {
+	// The greeting, such as "Hello World".
+	Greeting string `protobuf:"bytes,1,opt,name=greeting,proto3" json:"greeting,omitempty"`
+	// The language of the greeting, such as "english".
+	Language             string   `protobuf:"bytes,2,opt,name=language,proto3" json:"language,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *WatchGreetingResponse) Reset()         { *m = WatchGreetingResponse{} }
+func (m *WatchGreetingResponse) String() string { return proto.CompactTextString(m) }
+func (*WatchGreetingResponse) ProtoMessage()    {}
+func (*WatchGreetingResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_5c3dc59179dc9426, []int{3}
+}
+
+func (m *WatchGreetingResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchGreetingResponse.Unmarshal(m, b)
+}
+func (m *WatchGreetingResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchGreetingResponse.Marshal(b, m, deterministic)
+}
+func (m *WatchGreetingResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchGreetingResponse.Merge(m, src)
+}
+func (m *WatchGreetingResponse) XXX_Size() int {
+	return xxx_messageInfo_WatchGreetingResponse.Size(m)
+}
+func (m *WatchGreetingResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchGreetingResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchGreetingResponse proto.InternalMessageInfo
+
+func (m *WatchGreetingResponse) GetGreeting() string {
+	if m != nil {
+		return m.Greeting
+	}
+	return ""
+}
+
+func (m *WatchGreetingResponse) GetLanguage() string {
+	if m != nil {
+		return m.Language
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*SayHelloRequest)(nil), "hello.v1.SayHelloRequest")
+	proto.RegisterType((*SayHelloResponse)(nil), "hello.v1.SayHelloResponse")
+	proto.RegisterType((*WatchGreetingRequest)(nil), "hello.v1.WatchGreetingRequest")
+	proto.RegisterType((*WatchGreetingResponse)(nil), "hello.v1.WatchGreetingResponse")
+}
+
+func init() { proto.RegisterFile("hello/v1/hello.proto", fileDescriptor_5c3dc59179dc9426) }
+
+var fileDescriptor_5c3dc59179dc9426 = []byte{
+	// 196 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0xc9, 0x48, 0xcd, 0xc9,
+	0xc9, 0xd7, 0x2f, 0x33, 0xd4, 0x07, 0x33, 0xf4, 0x0a, 0x8a, 0xf2, 0x4b, 0xf2, 0x85, 0x38, 0x20,
+	0x9c, 0x32, 0x43, 0x25, 0x41, 0x2e, 0xfe, 0xe0, 0xc4, 0x4a, 0x0f, 0x10, 0x37, 0x28, 0xb5, 0xb0,
+	0x34, 0xb5, 0xb8, 0x44, 0xc9, 0x8b, 0x4b, 0x00, 0x21, 0x54, 0x5c, 0x90, 0x9f, 0x57, 0x9c, 0x2a,
+	0x24, 0xc5, 0xc5, 0x91, 0x5e, 0x94, 0x9a, 0x5a, 0x92, 0x99, 0x97, 0x2e, 0xc1, 0xa8, 0xc0, 0xa8,
+	0xc1, 0x19, 0x04, 0xe7, 0x83, 0xe4, 0x72, 0x12, 0xf3, 0xd2, 0x4b, 0x13, 0xd3, 0x53, 0x25, 0x98,
+	0x20, 0x72, 0x30, 0xbe, 0x92, 0x18, 0x97, 0x48, 0x78, 0x62, 0x49, 0x72, 0x86, 0x3b, 0x54, 0x31,
+	0xcc, 0x0e, 0x7f, 0x2e, 0x51, 0x34, 0x71, 0xca, 0x2c, 0x32, 0x5a, 0xc0, 0xc8, 0xc5, 0x0e, 0x36,
+	0x2c, 0xb5, 0x48, 0xc8, 0x91, 0x8b, 0x03, 0xe6, 0x01, 0x21, 0x49, 0x3d, 0x98, 0x57, 0xf5, 0xd0,
+	0xfc, 0x29, 0x25, 0x85, 0x4d, 0x0a, 0xea, 0x8c, 0x20, 0x2e, 0x5e, 0x14, 0xf7, 0x09, 0xc9, 0x21,
+	0x14, 0x63, 0xf3, 0x90, 0x94, 0x3c, 0x4e, 0x79, 0x88, 0x89, 0x06, 0x8c, 0x4e, 0x9c, 0x51, 0xec,
+	0x60, 0x35, 0x65, 0x86, 0x49, 0x6c, 0xe0, 0x68, 0x30, 0x06, 0x0c, 0x00, 0xab, 0x60, 0x50, 0x71,
+	0x9e, 0x01, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// GreeterClient is the client API for Greeter service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type GreeterClient interface {
+	// SayHello returns the greeting in the current language.
+	SayHello(ctx context.Context, in *SayHelloRequest, opts ...grpc.CallOption) (*SayHelloResponse, error)
+	// WatchGreeting sends the current greeting, then a new one whenever the
+	// language changes.
+	WatchGreeting(ctx context.Context, in *WatchGreetingRequest, opts ...grpc.CallOption) (Greeter_WatchGreetingClient, error)
+}
+
+type greeterClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewGreeterClient(cc *grpc.ClientConn) GreeterClient {
+	return &greeterClient{cc}
+}
+
+func (c *greeterClient) SayHello(ctx context.Context, in *SayHelloRequest, opts ...grpc.CallOption) (*SayHelloResponse, error) {
+	out := new(SayHelloResponse)
+	err := c.cc.Invoke(ctx, "/hello.v1.Greeter/SayHello", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *greeterClient) WatchGreeting(ctx context.Context, in *WatchGreetingRequest, opts ...grpc.CallOption) (Greeter_WatchGreetingClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Greeter_serviceDesc.Streams[0], "/hello.v1.Greeter/WatchGreeting", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &greeterWatchGreetingClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Greeter_WatchGreetingClient interface {
+	Recv() (*WatchGreetingResponse, error)
+	grpc.ClientStream
+}
+
+type greeterWatchGreetingClient struct {
+	grpc.ClientStream
+}
+
+func (x *greeterWatchGreetingClient) Recv() (*WatchGreetingResponse, error) {
+	m := new(WatchGreetingResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GreeterServer is the server API for Greeter service.
+type GreeterServer interface {
+	// SayHello returns the greeting in the current language.
+	SayHello(context.Context, *SayHelloRequest) (*SayHelloResponse, error)
+	// WatchGreeting sends the current greeting, then a new one whenever the
+	// language changes.
+	WatchGreeting(*WatchGreetingRequest, Greeter_WatchGreetingServer) error
+}
+
+// UnimplementedGreeterServer can be embedded to have forward compatible implementations.
+type UnimplementedGreeterServer struct {
+}
+
+func (*UnimplementedGreeterServer) SayHello(ctx context.Context, req *SayHelloRequest) (*SayHelloResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SayHello not implemented")
+}
+func (*UnimplementedGreeterServer) WatchGreeting(req *WatchGreetingRequest, srv Greeter_WatchGreetingServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchGreeting not implemented")
+}
+
+func RegisterGreeterServer(s *grpc.Server, srv GreeterServer) {
+	s.RegisterService(&_Greeter_serviceDesc, srv)
+}
+
+func _Greeter_SayHello_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SayHelloRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GreeterServer).SayHello(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/hello.v1.Greeter/SayHello",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GreeterServer).SayHello(ctx, req.(*SayHelloRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Greeter_WatchGreeting_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchGreetingRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GreeterServer).WatchGreeting(m, &greeterWatchGreetingServer{stream})
+}
+
+type Greeter_WatchGreetingServer interface {
+	Send(*WatchGreetingResponse) error
+	grpc.ServerStream
+}
+
+type greeterWatchGreetingServer struct {
+	grpc.ServerStream
+}
+
+func (x *greeterWatchGreetingServer) Send(m *WatchGreetingResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Greeter_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "hello.v1.Greeter",
+	HandlerType: (*GreeterServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SayHello",
+			Handler:    _Greeter_SayHello_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchGreeting",
+			Handler:       _Greeter_WatchGreeting_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "hello/v1/hello.proto",
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// registrationCheckInterval is how often the agent is asked whether it
+	// still has the service registered.
+	registrationCheckInterval = 10 * time.Second
+
+	// registrationMaxBackoff caps the wait between failed registrations.
+	registrationMaxBackoff = 30 * time.Second
+)
+
+// agentService is a service definition for /v1/agent/service/register.
+// See: https://www.consul.io/api/agent/service.html#register-service
+type agentService struct {
+	ID      string
+	Name    string
+	Address string               `json:",omitempty"`
+	Port    int                  `json:",omitempty"`
+	Tags    []string             `json:",omitempty"`
+	Meta    map[string]string    `json:",omitempty"`
+	Checks  []agentCheck         `json:",omitempty"`
+	Connect *agentServiceConnect `json:",omitempty"`
+}
+
+// agentServiceConnect is the Connect configuration of a service definition.
+type agentServiceConnect struct {
+	Native bool
+}
+
+// agentCheck is a check definition registered along with the service.
+type agentCheck struct {
+	CheckID       string
+	Name          string
+	HTTP          string `json:",omitempty"`
+	Method        string `json:",omitempty"`
+	TLSSkipVerify bool   `json:",omitempty"`
+	Interval      string `json:",omitempty"`
+	TTL           string `json:",omitempty"`
+}
+
+// serviceDefinition builds the registration for cfg. port is the port the
+// service listens on, used unless register_port is set.
+func (s *server) serviceDefinition(cfg *serverConfig, port int) agentService {
+	svc := agentService{
+		ID:      serviceID(cfg),
+		Name:    StringVal(cfg.RegisterName),
+		Address: StringVal(cfg.RegisterAddress),
+		Port:    port,
+		Tags:    SliceVal(cfg.RegisterTags),
+	}
+	if p := IntVal(cfg.RegisterPort); p != 0 {
+		svc.Port = p
+	}
+	// register_meta may override the metrics endpoint, such as when its port
+	// is mapped
+	svc.Meta = metricsMeta(s.metricsAddr, s.metricsPath)
+	if meta := SliceVal(cfg.RegisterMeta); len(meta) > 0 {
+		if svc.Meta == nil {
+			svc.Meta = make(map[string]string, len(meta))
+		}
+		for _, entry := range meta {
+			kv := strings.SplitN(entry, "=", 2)
+			svc.Meta[kv[0]] = kv[1]
+		}
+	}
+	svc.Checks = append(s.checkDefinitions(cfg, svc), s.healthCheckDefinitions(cfg, svc)...)
+	svc.Connect = s.connectDefinition()
+	return svc
+}
+
+// serviceID returns register_id, or service_name without its trailing '/'.
+func serviceID(cfg *serverConfig) string {
+	if id := StringVal(cfg.RegisterID); id != "" {
+		return id
+	}
+	return strings.TrimSuffix(StringVal(cfg.ServiceName), "/")
+}
+
+// listenPort returns the port of a listen address such as ":8080".
+func listenPort(addr string) (int, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address '%s': %v", addr, err)
+	}
+	return strconv.Atoi(port)
+}
+
+// runRegistration keeps the service registered with the local agent while
+// register_service is enabled. Registration is retried with backoff until it
+// succeeds, repeated when the definition changes or the agent loses it, and
+// the service is deregistered once ctx is done.
+func (s *server) runRegistration(ctx context.Context, port int) {
+	var (
+		registered *agentService
+		backoff    = time.Second
+	)
+	for {
+		wait := registrationCheckInterval
+
+		cfg := s.config()
+		switch def := s.serviceDefinition(cfg, port); {
+		case !BoolVal(cfg.RegisterService):
+			if registered != nil {
+				s.deregisterService(ctx, registered.ID)
+				registered = nil
+			}
+
+		case registered == nil || !reflect.DeepEqual(*registered, def) || !s.stillRegistered(ctx, def.ID):
+			if registered != nil && registered.ID != def.ID {
+				s.deregisterService(ctx, registered.ID)
+			}
+			if err := s.registerService(ctx, def); err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				logger("registration").Error("failed to register service", "service_id", def.ID, "error", err, "retry_in", backoff)
+				wait = backoff
+				if backoff *= 2; backoff > registrationMaxBackoff {
+					backoff = registrationMaxBackoff
+				}
+				registered = nil
+				break
+			}
+			logger("registration").Info("registered service", "service", def.Name, "service_id", def.ID)
+			registered = &def
+			backoff = time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			if registered != nil {
+				// ctx is done, give deregistration its own deadline
+				dctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				s.deregisterService(dctx, registered.ID)
+				cancel()
+			}
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// registerService registers def with the local agent.
+func (s *server) registerService(ctx context.Context, def agentService) error {
+	body, err := json.Marshal(def)
+	if err != nil {
+		return fmt.Errorf("failed to encode service definition: %v", err)
+	}
+	resp, err := s.consulPut(ctx, "/v1/agent/service/register", body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to register service. code: %d, resp: %s", resp.StatusCode, resp.Body)
+	}
+	return nil
+}
+
+// stillRegistered reports whether the local agent knows the service. Errors
+// are logged and reported as registered, so that an unreachable agent does
+// not cause registration churn.
+func (s *server) stillRegistered(ctx context.Context, id string) bool {
+	resp, err := s.consulGet(ctx, "/v1/agent/service/"+url.PathEscape(id), 0)
+	switch {
+	case err != nil:
+		if ctx.Err() == nil && !errors.Is(err, errACLDenied) {
+			logger("registration").Error("failed to look up service", "service_id", id, "error", err)
+		}
+		return true
+	case resp.StatusCode == http.StatusNotFound:
+		logger("registration").Warn("agent lost service, registering it again", "service_id", id)
+		return false
+	}
+	return true
+}
+
+// deregisterService removes the service from the local agent.
+func (s *server) deregisterService(ctx context.Context, id string) {
+	resp, err := s.consulPut(ctx, "/v1/agent/service/deregister/"+url.PathEscape(id), nil)
+	if err != nil {
+		logger("registration").Error("failed to deregister service", "service_id", id, "error", err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		logger("registration").Error("failed to deregister service", "service_id", id, "code", resp.StatusCode, "response", string(resp.Body))
+		return
+	}
+	logger("registration").Info("deregistered service", "service_id", id)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// relabel applies rules to labels the way Prometheus does, supporting the
+// keep and replace actions. It returns nil if the target is dropped.
+func relabel(t *testing.T, labels map[string]string, rules []relabelConfig) map[string]string {
+	t.Helper()
+
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+	for _, rule := range rules {
+		values := make([]string, len(rule.SourceLabels))
+		for i, name := range rule.SourceLabels {
+			values[i] = out[name]
+		}
+		sep, expr, repl, action := rule.Separator, rule.Regex, rule.Replacement, rule.Action
+		if sep == "" {
+			sep = ";"
+		}
+		if expr == "" {
+			expr = "(.*)"
+		}
+		if repl == "" {
+			repl = "$1"
+		}
+		if action == "" {
+			action = "replace"
+		}
+
+		re := regexp.MustCompile("^(?:" + expr + ")$")
+		value := strings.Join(values, sep)
+		match := re.FindStringSubmatchIndex(value)
+		switch action {
+		case "keep":
+			if match == nil {
+				return nil
+			}
+		case "replace":
+			if match != nil {
+				out[rule.TargetLabel] = string(re.ExpandString(nil, repl, value, match))
+			}
+		default:
+			t.Fatalf("unsupported action %q", action)
+		}
+	}
+	return out
+}
+
+func TestNewScrapeConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ConsulAddr = StringPtr("https://consul.example.com:8501")
+	cfg.RegisterName = StringPtr("hello")
+
+	pc, err := newScrapeConfig(cfg, "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pc.ScrapeConfigs) != 1 {
+		t.Fatalf("got %d scrape configs, want 1", len(pc.ScrapeConfigs))
+	}
+	sc := pc.ScrapeConfigs[0]
+	if sc.JobName != "hello" || sc.MetricsPath != "/metrics" {
+		t.Errorf("got job %q with path %q", sc.JobName, sc.MetricsPath)
+	}
+	want := []consulSD{{Server: "consul.example.com:8501", Scheme: "https", Services: []string{"hello"}}}
+	if !reflect.DeepEqual(sc.ConsulSD, want) {
+		t.Errorf("consul_sd_configs: got %+v, want %+v", sc.ConsulSD, want)
+	}
+
+	// The rules only use the meta keys the service advertises
+	const prefix = "__meta_consul_service_metadata_"
+	advertised := metricsMeta(":9091", "/custom")
+	for _, rule := range sc.RelabelConfigs {
+		for _, label := range rule.SourceLabels {
+			if key := strings.TrimPrefix(label, prefix); key != label {
+				if _, ok := advertised[key]; !ok {
+					t.Errorf("relabel rule uses meta key %q, which metricsMeta does not set", key)
+				}
+			}
+		}
+	}
+
+	labels := map[string]string{
+		"__address__":                   "10.0.0.5:8080",
+		"__metrics_path__":              "/metrics",
+		"__meta_consul_address":         "10.0.0.5",
+		"__meta_consul_service_address": "",
+		"__meta_consul_service_id":      "hello-http",
+		prefix + metaMetricsPort:        advertised[metaMetricsPort],
+		prefix + metaMetricsPath:        advertised[metaMetricsPath],
+	}
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		address string
+		path    string
+	}{
+		{"node address", nil, "10.0.0.5:9091", "/custom"},
+		{"service address", map[string]string{"__meta_consul_service_address": "10.1.0.7"}, "10.1.0.7:9091", "/custom"},
+		{"default path", map[string]string{prefix + metaMetricsPath: ""}, "10.0.0.5:9091", "/metrics"},
+		{"not advertised", map[string]string{prefix + metaMetricsPort: ""}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := make(map[string]string)
+			for k, v := range labels {
+				in[k] = v
+			}
+			for k, v := range tt.labels {
+				in[k] = v
+			}
+
+			out := relabel(t, in, sc.RelabelConfigs)
+			if tt.address == "" {
+				if out != nil {
+					t.Errorf("target was kept: %v", out)
+				}
+				return
+			}
+			if out == nil {
+				t.Fatal("target was dropped")
+			}
+			if out["__address__"] != tt.address || out["__metrics_path__"] != tt.path {
+				t.Errorf("got %s%s, want %s%s", out["__address__"], out["__metrics_path__"], tt.address, tt.path)
+			}
+			if out["instance"] != "hello-http" {
+				t.Errorf("instance: got %q", out["instance"])
+			}
+		})
+	}
+}
+
+func TestNewScrapeConfigUnixSocket(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ConsulAddr = StringPtr("unix:///var/run/consul.sock")
+	if _, err := newScrapeConfig(cfg, "/metrics"); err == nil {
+		t.Error("got no error for a unix socket consul_addr")
+	}
+}
+
+func TestWriteScrapeConfig(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "config.json")
+	body := `{"consul_addr": "http://127.0.0.1:8500", "register_name": "greeter"}`
+	if err := ioutil.WriteFile(cfgFile, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeScrapeConfig(&buf, cfgFile, &serverConfig{}, "/metrics"); err != nil {
+		t.Fatal(err)
+	}
+	var got promConfig
+	if err := yaml.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid YAML: %v\n%s", err, buf.String())
+	}
+	if len(got.ScrapeConfigs) != 1 || got.ScrapeConfigs[0].JobName != "greeter" {
+		t.Fatalf("unexpected scrape config:\n%s", buf.String())
+	}
+	sd := got.ScrapeConfigs[0].ConsulSD
+	if len(sd) != 1 || sd[0].Server != "127.0.0.1:8500" || sd[0].Scheme != "http" {
+		t.Errorf("consul_sd_configs: got %+v", sd)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address that was free when it was checked.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+// TestShutdownDrainsInFlightRequests checks that a request in flight when the
+// service starts draining completes, and that /healthz fails meanwhile.
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	s := newTestServer(t, map[string]interface{}{"drain_period": "200ms"})
+	for _, key := range SliceVal(s.config().ToWatch) {
+		s.synced.Store(key, time.Now())
+	}
+
+	// The slow request outlives the drain period, so it is still in flight
+	// when the servers stop
+	started := make(chan struct{})
+	s.router.HandleFunc("GET", "/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	addr := freeAddr(t)
+	served := make(chan error, 1)
+	go func() { served <- s.listenAndServe(addr) }()
+
+	base := "http://" + addr
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Get(base + "/healthz"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("server did not start: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /healthz before shutdown: got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		slow <- result{code: resp.StatusCode, body: string(body), err: err}
+	}()
+	<-started
+
+	deregistered := make(chan struct{})
+	close(deregistered)
+	go s.shutdown(syscall.SIGTERM, make(chan os.Signal), func() {}, deregistered)
+
+	// New requests are still served while draining, but fail the check
+	for !s.life.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	resp, err = http.Get(base + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz while draining: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("GET /healthz while draining: got %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+
+	res := <-slow
+	if res.err != nil {
+		t.Fatalf("in-flight request was cut off: %v", res.err)
+	}
+	if res.code != http.StatusOK || res.body != "done" {
+		t.Errorf("in-flight request: got %d %q, want %d %q", res.code, res.body, http.StatusOK, "done")
+	}
+
+	select {
+	case <-s.life.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not complete")
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("listenAndServe: got %v, want %v", err, http.ErrServerClosed)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// templateRetry is how long to wait before rendering again after a failure
+// that is not tied to a watched dependency, such as Consul being unreachable.
+const templateRetry = 10 * time.Second
+
+// templateRenderer renders a config template with data from Consul, in the
+// style of consul-template, and writes the result to the config file. Every
+// KV key and service read by the template is watched, and the template is
+// rendered again whenever one of them changes.
+type templateRenderer struct {
+	s    *server
+	tmpl *template.Template
+	dst  string
+
+	limit rate.Limit
+	burst int
+
+	// changed is signalled by watchers when a dependency changes.
+	changed chan struct{}
+
+	mu   sync.Mutex
+	ctx  context.Context
+	deps map[string]*templateDep
+	used map[string]bool
+}
+
+// templateDep is a Consul query the template depends on, along with its
+// latest result.
+type templateDep struct {
+	status int
+	body   []byte
+	cancel context.CancelFunc
+}
+
+// templateService is a healthy service instance as returned by the
+// `service` template function.
+type templateService struct {
+	ID      string
+	Name    string
+	Node    string
+	Address string
+	Port    int
+	Tags    []string
+}
+
+func newTemplateRenderer(s *server, src, dst string, limit rate.Limit, burst int) (*templateRenderer, error) {
+	r := templateRenderer{
+		s:       s,
+		dst:     dst,
+		limit:   limit,
+		burst:   burst,
+		changed: make(chan struct{}, 1),
+		deps:    make(map[string]*templateDep),
+	}
+
+	tmpl, err := template.New(filepath.Base(src)).Funcs(r.funcs()).ParseFiles(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template '%s': %v", src, err)
+	}
+	r.tmpl = tmpl
+	return &r, nil
+}
+
+func (r *templateRenderer) funcs() template.FuncMap {
+	return template.FuncMap{
+		"key": func(key string) (string, error) {
+			val, ok, err := r.key(key)
+			if err != nil {
+				return "", err
+			}
+			if !ok {
+				return "", fmt.Errorf("key '%s' does not exist", key)
+			}
+			return val, nil
+		},
+		"keyOrDefault": func(key, def string) (string, error) {
+			val, ok, err := r.key(key)
+			if err != nil {
+				return "", err
+			}
+			if !ok {
+				return def, nil
+			}
+			return val, nil
+		},
+		"service": r.service,
+		"env":     os.Getenv,
+	}
+}
+
+// run renders the template again every time a dependency changes, and
+// retries after failures. The first render is done by the caller through
+// renderAndReload.
+func (r *templateRenderer) run(ctx context.Context, lastErr error) {
+	for {
+		var retry <-chan time.Time
+		if lastErr != nil {
+			retry = time.After(templateRetry)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.changed:
+		case <-retry:
+		}
+		lastErr = r.renderAndReload(ctx)
+	}
+}
+
+// renderAndReload renders the template and, if the output differs from the
+// config file, writes it and reloads the config as if on SIGHUP.
+func (r *templateRenderer) renderAndReload(ctx context.Context) error {
+	out, err := r.render(ctx)
+	if err != nil {
+		logger("template").Error("failed to render", "error", err)
+		return err
+	}
+
+	current, err := ioutil.ReadFile(r.dst)
+	if err == nil && bytes.Equal(current, out) {
+		return nil
+	}
+	if err := writeFileAtomic(r.dst, out); err != nil {
+		logger("template").Error("failed to write output", "file", r.dst, "error", err)
+		return err
+	}
+	logger("template").Info("rendered template, reloading config", "file", r.dst)
+
+	// A rejected config is not a render failure, there is nothing to retry
+	r.s.reloadFrom(triggerTemplate, "")
+	return nil
+}
+
+// render executes the template. Watches are started for new dependencies
+// and stopped for those the template no longer reads.
+func (r *templateRenderer) render(ctx context.Context) ([]byte, error) {
+	r.mu.Lock()
+	r.ctx = ctx
+	r.used = make(map[string]bool)
+	r.mu.Unlock()
+
+	var buf bytes.Buffer
+	err := r.tmpl.Execute(&buf, nil)
+
+	r.mu.Lock()
+	for path, dep := range r.deps {
+		if !r.used[path] {
+			dep.cancel()
+			delete(r.deps, path)
+		}
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fetch returns the latest result for a Consul query. The first time a query
+// is seen it is made directly and a watch is started for it.
+func (r *templateRenderer) fetch(path string) (int, []byte, error) {
+	r.mu.Lock()
+	r.used[path] = true
+	dep, ok := r.deps[path]
+	if ok {
+		defer r.mu.Unlock()
+		return dep.status, dep.body, nil
+	}
+	ctx := r.ctx
+	r.mu.Unlock()
+
+	resp, err := r.s.consulGet(ctx, path, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	r.mu.Lock()
+	r.deps[path] = &templateDep{
+		status: resp.StatusCode,
+		body:   resp.Body,
+		cancel: cancel,
+	}
+	r.mu.Unlock()
+
+	go r.watch(watchCtx, path, resp.Index)
+	return resp.StatusCode, resp.Body, nil
+}
+
+// watch makes blocking queries for a dependency and signals a render when its
+// result changes.
+func (r *templateRenderer) watch(ctx context.Context, path string, index uint64) {
+	limiter := rate.NewLimiter(r.limit, r.burst)
+
+	for {
+		// Only fails once the watch is cancelled
+		if err := limiter.Wait(ctx); err != nil {
+			return
+		}
+
+		// Reset if it goes backwards or is 0
+		// See: https://www.consul.io/api/features/blocking.html#implementation-details
+		if index == 0 {
+			index = 1
+		}
+		resp, err := r.s.consulGet(ctx, path, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger("template").Error("watch failed", "path", path, "error", err)
+			continue
+		}
+		if resp.Index < index {
+			logger("template").Debug("index went backwards, resetting", "path", path, "index", index, "new_index", resp.Index)
+			index = 0
+			continue
+		}
+		if resp.Index == index {
+			// Wait elapsed without changes
+			continue
+		}
+		index = resp.Index
+
+		r.mu.Lock()
+		dep, ok := r.deps[path]
+		changed := ok && (dep.status != resp.StatusCode || !bytes.Equal(dep.body, resp.Body))
+		if changed {
+			dep.status = resp.StatusCode
+			dep.body = resp.Body
+		}
+		r.mu.Unlock()
+
+		if changed {
+			logger("template").Info("dependency changed", "path", path)
+			select {
+			case r.changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// key returns the value of a KV key and whether it exists.
+func (r *templateRenderer) key(key string) (string, bool, error) {
+	status, body, err := r.fetch("/v1/kv/" + key)
+	if err != nil {
+		return "", false, err
+	}
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("failed to get key '%s'. code: %d, resp: %s", key, status, body)
+	}
+
+	data := make([]keyResponse, 0)
+	if err := json.Unmarshal(body, &data); err != nil {
+		return "", false, fmt.Errorf("failed to decode key '%s': %v", key, err)
+	}
+	if len(data) == 0 {
+		return "", false, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data[0].Value)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to decode value of key '%s': %v", key, err)
+	}
+	return string(decoded), true, nil
+}
+
+// service returns the passing instances of a service.
+func (r *templateRenderer) service(name string) ([]templateService, error) {
+	status, body, err := r.fetch("/v1/health/service/" + url.PathEscape(name) + "?passing")
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("failed to get service '%s'. code: %d, resp: %s", name, status, body)
+	}
+
+	var entries []struct {
+		Node struct {
+			Node    string
+			Address string
+		}
+		Service struct {
+			ID      string
+			Service string
+			Address string
+			Port    int
+			Tags    []string
+		}
+	}
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode service '%s': %v", name, err)
+	}
+
+	out := make([]templateService, 0, len(entries))
+	for _, e := range entries {
+		svc := templateService{
+			ID:      e.Service.ID,
+			Name:    e.Service.Service,
+			Node:    e.Node.Node,
+			Address: e.Service.Address,
+			Port:    e.Service.Port,
+			Tags:    e.Service.Tags,
+		}
+		// Instances without an address are reachable at the node's address
+		if svc.Address == "" {
+			svc.Address = e.Node.Address
+		}
+		out = append(out, svc)
+	}
+	return out, nil
+}
+
+// writeFileAtomic replaces filename with data through a rename, so readers
+// never see a partially written file.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for '%s': %v", filename, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write '%s': %v", tmp.Name(), err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to chmod '%s': %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close '%s': %v", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("failed to replace '%s': %v", filename, err)
+	}
+	return nil
+}
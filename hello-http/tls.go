@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate in tls_cert_file and tls_key_file, and
+// swaps it when the files change. When tls_ca_file is set, clients must
+// present a certificate signed by one of its CAs. Connections that are
+// already established keep the certificates they were started with.
+type certReloader struct {
+	s *server
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	caPool   *x509.CertPool
+	certFile string
+	keyFile  string
+	caFile   string
+	modTime  time.Time
+}
+
+func newCertReloader(s *server) (*certReloader, error) {
+	c := certReloader{s: s}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// tlsConfig returns a server TLS config that always uses the latest
+// certificate and client CAs.
+func (c *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     c.getCertificate,
+		GetConfigForClient: c.getConfigForClient,
+	}
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
+
+func (c *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	cfg := tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*c.cert},
+	}
+	if c.caPool != nil {
+		cfg.ClientCAs = c.caPool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &cfg, nil
+}
+
+// reload loads the certificate if the configured files or their modification
+// times changed since the last load. The current certificate is kept if the
+// new one cannot be loaded.
+func (c *certReloader) reload() error {
+	cfg := c.s.config()
+	certFile, keyFile := StringVal(cfg.TLSCertFile), StringVal(cfg.TLSKeyFile)
+	caFile := StringVal(cfg.TLSCAFile)
+
+	files := []string{certFile, keyFile}
+	if caFile != "" {
+		files = append(files, caFile)
+	}
+	modTime, err := latestModTime(files...)
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	unchanged := c.cert != nil && certFile == c.certFile && keyFile == c.keyFile &&
+		caFile == c.caFile && modTime.Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair from '%s' and '%s': %v", certFile, keyFile, err)
+	}
+	var caPool *x509.CertPool
+	if caFile != "" {
+		if caPool, err = loadCAPool(caFile); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.caPool = caPool
+	c.certFile = certFile
+	c.keyFile = keyFile
+	c.caFile = caFile
+	c.modTime = modTime
+	c.mu.Unlock()
+
+	logger("tls").Info("loaded certificate", "file", certFile)
+	if caFile != "" {
+		logger("tls").Info("requiring client certificates", "ca_file", caFile)
+	}
+	return nil
+}
+
+// watch reloads the certificate when its files change.
+func (c *certReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.reload(); err != nil {
+				logger("tls").Error("failed to reload certificate, keeping current one", "error", err)
+			}
+		}
+	}
+}
+
+// listenAndServe serves the router on addr, over HTTPS when a certificate is
+// configured.
+func (s *server) listenAndServe(addr string) error {
+	srv := http.Server{
+		Addr:     addr,
+		Handler:  s.router,
+		ErrorLog: stdLogger("http", slog.LevelWarn),
+	}
+	s.life.onStop("http", srv.Shutdown)
+	if s.certs == nil {
+		return srv.ListenAndServe()
+	}
+
+	logger("tls").Info("serving HTTPS", "addr", addr)
+	srv.TLSConfig = s.certs.tlsConfig()
+	return srv.ListenAndServeTLS("", "")
+}
+
+// loadCAPool reads the PEM encoded CA certificates in a file.
+func loadCAPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file '%s': %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file '%s'", caFile)
+	}
+	return pool, nil
+}
+
+// latestModTime returns the most recent modification time of the files.
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat '%s': %v", f, err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
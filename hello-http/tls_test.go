@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate generated for a test, with its key.
+type testCert struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// generateCert creates a certificate from tmpl, signed by parent or
+// self-signed when parent is nil. Validity and serial default to sensible
+// values when unset.
+func generateCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.SerialNumber == nil {
+		tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	}
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+	}
+	signerCert, signerKey := tmpl, crypto.Signer(key)
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, key.Public(), signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// generateCA creates a self-signed CA certificate.
+func generateCA(t *testing.T, name string) *testCert {
+	return generateCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}, nil)
+}
+
+// generateServerCert creates a self-signed certificate for localhost with the
+// given serial.
+func generateServerCert(t *testing.T, serial int64) *testCert {
+	return generateCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil)
+}
+
+// writeCert writes the certificate and key, moving their modification time
+// forward so that a reload sees them change.
+func writeCert(t *testing.T, c *testCert, certFile, keyFile string, modTime time.Time) {
+	t.Helper()
+
+	for file, body := range map[string][]byte{certFile: c.certPEM, keyFile: c.keyPEM} {
+		if err := ioutil.WriteFile(file, body, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serveTLS serves the server's router over TLS with cfg on a local address,
+// which it returns.
+func serveTLS(t *testing.T, s *server, cfg *tls.Config) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := http.Server{Handler: s.router}
+	go srv.Serve(tls.NewListener(lis, cfg))
+	t.Cleanup(func() { srv.Close() })
+	return lis.Addr().String()
+}
+
+// getHello sends GET /hello on an open connection, keeping it alive.
+func getHello(conn net.Conn) (int, error) {
+	if _, err := fmt.Fprint(conn, "GET /hello HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0, err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	writeCert(t, generateServerCert(t, 1), certFile, keyFile, now)
+
+	s := newTestServer(t, map[string]interface{}{
+		"tls_cert_file": certFile,
+		"tls_key_file":  keyFile,
+	})
+	c, err := newCertReloader(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, s, c.tlsConfig())
+
+	dial := func() (*tls.Conn, int64) {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	open, serial := dial()
+	defer open.Close()
+	if serial != 1 {
+		t.Fatalf("got serial %d, want 1", serial)
+	}
+	if code, err := getHello(open); err != nil || code != http.StatusOK {
+		t.Fatalf("GET /hello: got %d, %v", code, err)
+	}
+
+	writeCert(t, generateServerCert(t, 2), certFile, keyFile, now.Add(time.Minute))
+	if err := c.reload(); err != nil {
+		t.Fatal(err)
+	}
+	conn, serial := dial()
+	conn.Close()
+	if serial != 2 {
+		t.Errorf("after reload: got serial %d, want 2", serial)
+	}
+
+	// The connection established before the reload keeps working
+	if code, err := getHello(open); err != nil || code != http.StatusOK {
+		t.Errorf("GET /hello on the open connection: got %d, %v", code, err)
+	}
+
+	// A broken certificate is rejected and the current one kept
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, now.Add(2*time.Minute), now.Add(2*time.Minute))
+	if err := c.reload(); err == nil {
+		t.Error("reload accepted a broken certificate")
+	}
+	conn, serial = dial()
+	conn.Close()
+	if serial != 2 {
+		t.Errorf("after failed reload: got serial %d, want 2", serial)
+	}
+}
+
+func TestCertReloaderClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, generateServerCert(t, 1), certFile, keyFile, time.Now())
+
+	ca := generateCA(t, "clients")
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, ca.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	client := generateCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	clientPair, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t, map[string]interface{}{
+		"tls_cert_file": certFile,
+		"tls_key_file":  keyFile,
+		"tls_ca_file":   caFile,
+	})
+	c, err := newCertReloader(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, s, c.tlsConfig())
+
+	for _, tt := range []struct {
+		name  string
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{"with client certificate", []tls.Certificate{clientPair}, true},
+		{"without client certificate", nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, Certificates: tt.certs})
+			if err == nil {
+				defer conn.Close()
+				// With TLS 1.3 the server rejects the certificate after the
+				// client finished the handshake
+				_, err = getHello(conn)
+			}
+			if ok := err == nil; ok != tt.ok {
+				t.Errorf("got error %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// auditLogSize is the number of entries kept in the audit log.
+const auditLogSize = 256
+
+// Triggers recorded in the audit log as the source of a config change.
+const (
+	triggerKVWatch  = "kv-watch"
+	triggerHTTP     = "http"
+	triggerSignal   = "signal"
+	triggerFile     = "file"
+	triggerTemplate = "template"
+)
+
+// auditEntry records a change to the effective value of a config field.
+// Caller is the authenticated identity that asked for the change, if any.
+type auditEntry struct {
+	Time   time.Time   `json:"time"`
+	Source string      `json:"source"`
+	Caller string      `json:"caller,omitempty"`
+	Field  string      `json:"field"`
+	Old    interface{} `json:"old"`
+	New    interface{} `json:"new"`
+}
+
+// auditLog is a bounded, in-memory log of config changes. The oldest entries
+// are dropped once it is full.
+type auditLog struct {
+	mu      sync.Mutex
+	size    int
+	entries []auditEntry
+
+	// updated is signalled after every record, see server.mirrorAudit.
+	updated chan struct{}
+}
+
+func newAuditLog(size int) *auditLog {
+	return &auditLog{
+		size:    size,
+		entries: make([]auditEntry, 0, size),
+		updated: make(chan struct{}, 1),
+	}
+}
+
+// record appends an entry for each change.
+func (a *auditLog) record(source, caller string, changes []fieldChange) {
+	if len(changes) == 0 {
+		return
+	}
+	now := time.Now().UTC()
+
+	a.mu.Lock()
+	for _, c := range changes {
+		if len(a.entries) == a.size {
+			copy(a.entries, a.entries[1:])
+			a.entries = a.entries[:a.size-1]
+		}
+		a.entries = append(a.entries, auditEntry{
+			Time:   now,
+			Source: source,
+			Caller: caller,
+			Field:  c.Field,
+			Old:    c.Old,
+			New:    c.New,
+		})
+	}
+	a.mu.Unlock()
+
+	select {
+	case a.updated <- struct{}{}:
+	default:
+	}
+}
+
+// list returns a copy of the entries, oldest first.
+func (a *auditLog) list() []auditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	out := make([]auditEntry, len(a.entries))
+	copy(out, a.entries)
+	return out
+}
+
+// mirrorAudit writes the audit log to the Consul KV key in audit_kv_key every
+// time it changes. Nothing is written while the key is unset.
+func (s *server) mirrorAudit(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.audit.updated:
+		}
+
+		key := StringVal(s.config().AuditKVKey)
+		if key == "" {
+			continue
+		}
+
+		body, err := json.Marshal(s.audit.list())
+		if err != nil {
+			logger("audit").Error("failed to encode log", "error", err)
+			continue
+		}
+		resp, err := s.consulPut(ctx, "/v1/kv/"+key, body)
+		if err != nil {
+			logger("audit").Error("failed to mirror log", "key", key, "error", err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			logger("audit").Error("failed to mirror log", "key", key, "code", resp.StatusCode, "response", string(resp.Body))
+		}
+	}
+}
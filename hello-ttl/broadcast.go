@@ -0,0 +1,45 @@
+package main
+
+import "sync"
+
+// broadcast signals its subscribers that something changed. Signals are
+// coalesced, so subscribers look at the current state again rather than count
+// them.
+type broadcast struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]struct{}
+}
+
+// subscribe returns a channel that is signalled on every notify, until it is
+// passed to unsubscribe.
+func (b *broadcast) subscribe() chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subs == nil {
+		b.subs = make(map[chan struct{}]struct{})
+	}
+	ch := make(chan struct{}, 1)
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+func (b *broadcast) unsubscribe(ch chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subs, ch)
+}
+
+// notify signals every subscriber without blocking.
+func (b *broadcast) notify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
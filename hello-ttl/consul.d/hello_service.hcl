@@ -1,11 +0,0 @@
-service {
-  name = "hello"
-  port = 8080
-  checks = [
-    {
-      id = "hello-ttl"
-      name = "5s TTL"
-      ttl = "5s"
-    }
-  ]
-}
\ No newline at end of file
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileWatchDebounce is how long the config file must be quiet before it is
+// reloaded, so that a burst of writes causes a single reload.
+const fileWatchDebounce = 500 * time.Millisecond
+
+// watchConfigFile reloads the config whenever the content of the config file
+// changes. The directory is watched rather than the file itself: editors and
+// Kubernetes replace files instead of writing them in place, and ConfigMap
+// volumes are updated by swapping the `..data` symlink the file points
+// through.
+func (s *server) watchConfigFile(ctx context.Context) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger("filewatch").Error("failed to create watcher", "error", err)
+		return
+	}
+	defer w.Close()
+
+	dir := filepath.Dir(s.cfgFile)
+	if err := w.Add(dir); err != nil {
+		logger("filewatch").Error("failed to watch directory", "dir", dir, "error", err)
+		return
+	}
+	watchResolvedDir(w, s.cfgFile)
+	logger("filewatch").Info("watching config file for changes", "file", s.cfgFile)
+
+	last := hashFile(s.cfgFile)
+	debounce := time.NewTimer(fileWatchDebounce)
+	debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case _, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			// Any event in the directory may change what the path resolves
+			// to, the content hash below filters out the unrelated ones
+			debounce.Reset(fileWatchDebounce)
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			logger("filewatch").Error("watch failed", "error", err)
+
+		case <-debounce.C:
+			current := hashFile(s.cfgFile)
+			if bytes.Equal(current, last) {
+				continue
+			}
+			last = current
+			watchResolvedDir(w, s.cfgFile)
+			s.reloadFrom(triggerFile, "")
+		}
+	}
+}
+
+// watchResolvedDir adds the directory the config file resolves to when it is
+// reached through symlinks, so in-place edits of the target are seen as well.
+// Watches on directories that are later removed are dropped by fsnotify.
+func watchResolvedDir(w *fsnotify.Watcher, filename string) {
+	resolved, err := filepath.EvalSymlinks(filename)
+	if err != nil || filepath.Dir(resolved) == filepath.Dir(filename) {
+		return
+	}
+	if err := w.Add(filepath.Dir(resolved)); err != nil {
+		logger("filewatch").Warn("failed to watch directory", "dir", filepath.Dir(resolved), "error", err)
+	}
+}
+
+// hashFile returns the SHA-256 of a file's content, or nil if it cannot be
+// read.
+func hashFile(filename string) []byte {
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(body)
+	return sum[:]
+}
@@ -1,8 +1,22 @@
 module github.com/freddygv/consul-getting-started/hello-ttl
 
-go 1.12
+go 1.21
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/hashicorp/hcl v1.0.0
 	github.com/matryer/way v0.0.0-20180416093233-9632d0c407b0
+	github.com/prometheus/client_golang v1.1.0
 	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90 // indirect
+	github.com/prometheus/common v0.6.0 // indirect
+	github.com/prometheus/procfs v0.0.3 // indirect
+	golang.org/x/sys v0.4.0 // indirect
 )
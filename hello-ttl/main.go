@@ -4,299 +4,589 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"strconv"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/matryer/way"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/time/rate"
 )
 
 const (
-	limiterRate  = 0.1
-	limiterBurst = 2
-	ttlInterval  = 2 * time.Second
+	limiterRate    = 0.1
+	limiterBurst   = 2
+	ttlInterval    = 2 * time.Second
+	prometheusPort = ":9091"
 )
 
 func main() {
 	var (
-		httpAddr   = flag.String("addr", "localhost:8080", "Hello service address.")
-		configFile = flag.String("cfg-file", "config.json", "Path to config file.")
+		httpAddr       = flag.String("addr", "localhost:8080", "Hello service address.")
+		metricsAddr    = flag.String("metrics-addr", prometheusPort, "Address serving the Prometheus metrics.")
+		metricsPath    = flag.String("metrics-path", "/metrics", "Path of the Prometheus metrics.")
+		configFile     = flag.String("cfg-file", "config.json", "Path to config file.")
+		cfgTemplate    = flag.String("cfg-template", "", "Path to a config template to render into the config file using data from Consul.")
+		watchCfgFile   = flag.Bool("watch-cfg-file", true, "Reload the config when the config file changes.")
+		validateConfig = flag.Bool("validate-config", false, "Validate the config file and exit.")
+		scrapeConfig   = flag.Bool("scrape-config", false, "Print an example Prometheus scrape config discovering the service through Consul and exit.")
+		consulToken    = flag.String("consul-token", "", "ACL token for Consul requests. Defaults to CONSUL_HTTP_TOKEN.")
+		tokenFile      = flag.String("consul-token-file", "", "File holding the ACL token for Consul requests, read again when it changes. Defaults to CONSUL_HTTP_TOKEN_FILE.")
+		logFormat      = flag.String("log-format", logFormatText, "Format of the logs, 'text' or 'json'.")
+		flagConfig     = registerConfigFlags(flag.CommandLine)
 	)
 	flag.Parse()
 
-	log.Printf("[INFO] Starting server...")
-	s := newServer(StringVal(configFile))
+	if err := setupLogging(StringVal(logFormat)); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -log-format: %v\n", err)
+		os.Exit(1)
+	}
+	if BoolVal(validateConfig) {
+		if err := checkConfigFile(StringVal(configFile), flagConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "Config file '%s' is invalid: %v\n", StringVal(configFile), err)
+			os.Exit(1)
+		}
+		fmt.Printf("Config file '%s' is valid\n", StringVal(configFile))
+		return
+	}
+	if BoolVal(scrapeConfig) {
+		if err := writeScrapeConfig(os.Stdout, StringVal(configFile), flagConfig, StringVal(metricsPath)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to generate scrape config: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	logger("main").Info("starting server")
+	s := newServer(StringVal(configFile), flagConfig)
+	s.token = newConsulToken(StringVal(consulToken), StringVal(tokenFile))
+	prometheus.MustRegister(serverCollector{s: s})
+	s.metricsAddr, s.metricsPath = StringVal(metricsAddr), StringVal(metricsPath)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	log.Printf("[INFO] Running TTL check keep-alive")
+	logger("ttl").Info("running TTL check keep-alive")
 	s.runTTL(ctx, ttlInterval)
 
-	for _, key := range SliceVal(s.cfg.ToWatch) {
-		log.Printf("[INFO] Running watch for key '%s'", key)
+	if tmplFile := StringVal(cfgTemplate); tmplFile != "" {
+		tr, err := newTemplateRenderer(s, tmplFile, StringVal(configFile), limiterRate, limiterBurst)
+		if err != nil {
+			fatal("template", "failed to load template", "error", err)
+		}
+		logger("template").Info("rendering config template", "template", tmplFile, "file", StringVal(configFile))
+		err = tr.renderAndReload(ctx)
+		go tr.run(ctx, err)
+	}
+
+	cfg := s.config()
+	if len(SliceVal(cfg.AuthMethods)) == 0 {
+		logger("auth").Warn("no auth_methods configured, health and admin endpoints are open to anyone")
+	}
+	for _, key := range SliceVal(cfg.ToWatch) {
+		if _, ok := lookupKVField(key, StringVal(cfg.ServiceName)); !ok {
+			logger("watch").Warn("values will be ignored", "key", key, "error", errUnknownKey)
+		}
+		logger("watch").Info("running watch", "key", key)
 		go s.watchKV(ctx, key, limiterRate, limiterBurst)
 	}
 
-	go s.captureReload(ctx, StringVal(configFile))
+	if StringVal(cfg.TLSCertFile) != "" {
+		certs, err := newCertReloader(s)
+		if err != nil {
+			fatal("tls", "failed to set up HTTPS", "error", err)
+		}
+		s.certs = certs
+		go s.certs.watch(ctx)
+	}
+
+	go s.captureReload(ctx)
+	s.checks.run(ctx)
+	go s.runWatchdog(ctx)
 
-	log.Printf("[INFO] Hello service with TTL check listening on %s", StringVal(httpAddr))
-	log.Fatal(http.ListenAndServe(StringVal(httpAddr), s.router))
+	port, err := listenPort(StringVal(httpAddr))
+	if err != nil {
+		fatal("registration", "invalid listen address", "error", err)
+	}
+	deregistered := make(chan struct{})
+	go func() {
+		s.runRegistration(ctx, port)
+		close(deregistered)
+	}()
+	go s.captureShutdown(cancel, deregistered)
+
+	go s.mirrorAudit(ctx)
+	if BoolVal(watchCfgFile) {
+		go s.watchConfigFile(ctx)
+	}
+
+	logger("metrics").Info("exposing Prometheus metrics", "addr", StringVal(metricsAddr), "path", StringVal(metricsPath))
+	go s.runPrometheus(StringVal(metricsAddr), StringVal(metricsPath))
+
+	logger("main").Info("hello service with TTL check listening", "addr", StringVal(httpAddr))
+	s.started.Store(true)
+	if err := s.listenAndServe(StringVal(httpAddr)); err != http.ErrServerClosed {
+		fatal("http", "failed to serve", "error", err)
+	}
+	<-s.life.done
 }
 
 type server struct {
 	router *way.Router
-	cfg    *serverConfig
+
+	// cfg holds the current config snapshot. Snapshots are never modified
+	// once published, so readers can use them without locking.
+	cfg atomic.Pointer[serverConfig]
+
+	// mu serializes updates to cfg and guards the fields below.
+	mu      sync.Mutex
+	cfgFile string
+	layers  configLayers
+
+	audit *auditLog
+	auth  *authState
+
+	// token is the ACL token sent to Consul, denied holds the endpoints that
+	// rejected it as "METHOD path" keys.
+	token  *consulToken
+	denied sync.Map
+
+	// synced holds the time each watched key was last synced from Consul.
+	synced sync.Map
+
+	// started is set once the servers are started, and watchdog holds the
+	// time the watchdog last took mu, in Unix nanoseconds.
+	started  atomic.Bool
+	watchdog atomic.Int64
+
+	// checks runs the health checks, and health aggregates them into the
+	// status reported by the TTL check.
+	checks *healthRegistry
+	health healthEvaluator
+
+	consul *consulAgents
+
+	// metricsAddr and metricsPath locate the Prometheus metrics, advertised
+	// in the service meta.
+	metricsAddr string
+	metricsPath string
+
+	life *lifecycle
+
+	// certs is nil unless HTTPS is enabled.
+	certs *certReloader
 }
 
-func newServer(cfgFile string) *server {
-	config, err := loadConfig(cfgFile)
+func newServer(cfgFile string, flags *serverConfig) *server {
+	layers, err := newConfigLayers(cfgFile, flags)
+	if err != nil {
+		fatal("config", "failed to load config", "error", err)
+	}
+	config, err := layers.build()
 	if err != nil {
-		log.Printf("[WARN] failed to load config from file '%s', using default. err: %v", cfgFile, err)
+		fatal("config", "failed to load config", "error", err)
 	}
-	config = config.merge(defaultConfig())
 
 	s := server{
-		router: way.NewRouter(),
-		cfg:    config,
+		router:  way.NewRouter(),
+		cfgFile: cfgFile,
+		layers:  layers,
+		audit:   newAuditLog(auditLogSize),
+		life:    newLifecycle(),
 	}
-
-	s.router.HandleFunc("GET", "/hello", s.handleHello())
-	s.router.HandleFunc("PUT", "/health/pass", s.enableHealth())
-	s.router.HandleFunc("PUT", "/health/fail", s.disableHealth())
+	if s.consul, err = newConsulAgents(); err != nil {
+		fatal("consul", "failed to configure Consul client", "error", err)
+	}
+	s.auth = newAuthState(&s)
+	s.cfg.Store(config)
+	applyLogLevel(config)
+
+	s.watchdog.Store(time.Now().UnixNano())
+	s.checks = newHealthRegistry(s.onCheckResult)
+	s.health = aggregateHealth{s: &s}
+	s.registerBuiltinChecks()
+	s.syncHTTPChecks(config)
+
+	s.handle("GET", "/hello", s.handleHello())
+	s.handle("GET", "/livez", s.handleLivez())
+	s.handle("GET", "/readyz", s.handleReadyz())
+	s.handle("GET", "/startupz", s.handleStartupz())
+	s.handle("PUT", "/health/pass", s.requireAuth(s.enableHealth()))
+	s.handle("PUT", "/health/fail", s.requireAuth(s.disableHealth()))
+	s.handle("GET", "/admin/config", s.requireAuth(s.handleGetConfig()))
+	s.handle("PATCH", "/admin/config", s.requireAuth(s.handlePatchConfig()))
+	s.handle("POST", "/admin/config/persist", s.requireAuth(s.handlePersistConfig()))
+	s.handle("GET", "/admin/config/provenance", s.requireAuth(s.handleProvenance()))
+	s.handle("POST", "/admin/reload", s.requireAuth(s.handleReload()))
+	s.handle("GET", "/admin/audit", s.requireAuth(s.handleAudit()))
 
 	return &s
 }
 
+// config returns the current config snapshot. It must not be modified.
+func (s *server) config() *serverConfig {
+	return s.cfg.Load()
+}
+
+// update applies fn to a copy of the runtime config layer, then rebuilds and
+// publishes the config. Fields changed by fn are attributed to source, and
+// trigger and caller are recorded in the audit log. Updates are serialized,
+// and nothing is published if fn returns an error or the resulting config is
+// invalid.
+func (s *server) update(source, trigger, caller string, fn func(c *serverConfig) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	layers := s.layers.withRuntime()
+	if err := fn(layers.runtime); err != nil {
+		return err
+	}
+	for _, f := range configFields {
+		switch v := f.get(layers.runtime); {
+		case v == nil:
+			delete(layers.runtimeSources, f.name)
+		case !reflect.DeepEqual(v, f.get(s.layers.runtime)):
+			layers.runtimeSources[f.name] = source
+		}
+	}
+	_, err := s.publish(layers, trigger, caller)
+	return err
+}
+
+// reload re-reads the config file layer, then rebuilds and publishes the
+// config. The running config is kept if the file is missing or invalid.
+// Unlike at startup, a missing file is an error, so that deleting it does not
+// silently revert the service to the defaults.
+func (s *server) reload(trigger, caller string) ([]fieldChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := loadConfig(s.cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	layers := s.layers
+	layers.file = file
+	return s.publish(layers, trigger, caller)
+}
+
+// reloadFrom reloads the config and logs the outcome along with the fields
+// that changed. trigger names what caused the reload, and caller who asked for
+// it, if anyone.
+func (s *server) reloadFrom(trigger, caller string) ([]fieldChange, error) {
+	changes, err := s.reload(trigger, caller)
+	configReloads.WithLabelValues(trigger, result(err)).Inc()
+	if err != nil {
+		logger("config").Error("failed to reload config, keeping running config", "trigger", trigger, "error", err)
+		return nil, err
+	}
+
+	logger("config").Info("config reloaded", "trigger", trigger, "file", s.cfgFile, "changed", len(changes))
+	for _, c := range changes {
+		logger("config").Info("field changed", "trigger", trigger, "change", c.String())
+	}
+	return changes, nil
+}
+
+// publish builds the config from layers and stores both. The fields that
+// changed are recorded in the audit log under trigger and caller, and
+// returned. s.mu must be held.
+func (s *server) publish(layers configLayers, trigger, caller string) ([]fieldChange, error) {
+	config, err := layers.build()
+	if err != nil {
+		return nil, err
+	}
+	changes := diffConfig(s.cfg.Load(), config)
+	s.audit.record(trigger, caller, changes)
+
+	s.layers = layers
+	s.cfg.Store(config)
+	if len(changes) > 0 {
+		applyLogLevel(config)
+		s.syncHTTPChecks(config)
+		s.healthChanged()
+	}
+	return changes, nil
+}
+
+// checkConfigFile loads and validates a config file without starting the
+// service. Unlike at startup, the file must exist.
+func checkConfigFile(cfgFile string, flags *serverConfig) error {
+	if _, err := loadConfig(cfgFile); err != nil {
+		return err
+	}
+	layers, err := newConfigLayers(cfgFile, flags)
+	if err != nil {
+		return err
+	}
+	_, err = layers.build()
+	return err
+}
+
 // Reload config from file on HUP
-func (s *server) captureReload(ctx context.Context, cfgFile string) {
+func (s *server) captureReload(ctx context.Context) {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGHUP)
 
 	for {
 		select {
 		case sig := <-sigCh:
-			log.Printf("[INFO] captured signal: %v. reloading config...", sig)
-			config, err := loadConfig(cfgFile)
-			if err != nil {
-				log.Printf("[WARN] failed to load config from file '%s', using default. err: %v", cfgFile, err)
-			}
-			s.cfg.mu.Lock()
-			{
-				s.cfg = config.merge(s.cfg)
+			logger("config").Info("captured signal, reloading config", "signal", sig.String())
+			s.reloadFrom(triggerSignal, "")
+			if s.certs != nil {
+				if err := s.certs.reload(); err != nil {
+					logger("tls").Error("failed to reload certificate, keeping current one", "error", err)
+				}
 			}
-			s.cfg.mu.Unlock()
 		}
 	}
 }
 
+// greetings maps each supported language to its greeting.
+var greetings = map[string]string{
+	"english":    "Hello World",
+	"french":     "Bonjour Monde",
+	"portuguese": "Olá Mundo",
+	"spanish":    "Hola Mundo",
+}
+
+// runPrometheus serves the Prometheus metrics at path on addr.
+func (s *server) runPrometheus(addr, path string) {
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.Handler())
+	srv := http.Server{Addr: addr, Handler: mux}
+	s.life.onStop("metrics", srv.Shutdown)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logger("metrics").Error("failed to serve metrics", "error", err)
+	}
+}
+
 func (s *server) handleHello() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		s.cfg.mu.RLock()
-		defer s.cfg.mu.RUnlock()
-
-		switch StringVal(s.cfg.Language) {
-		case "french":
-			fmt.Fprintln(w, "Bonjour Monde")
-		case "portuguese":
-			fmt.Fprintln(w, "Olá Mundo")
-		case "spanish":
-			fmt.Fprintln(w, "Hola Mundo")
-		default:
-			fmt.Fprintln(w, "Hello World")
+		if id := peerIdentity(r); id != "" {
+			requestLogger(r, "hello").Info("request from peer", "peer", id)
 		}
+
+		greeting, _ := s.greeting()
+		fmt.Fprintln(w, greeting)
+	}
+}
+
+// greeting returns the greeting in the configured language, falling back to
+// english, and the language it is in.
+func (s *server) greeting() (string, string) {
+	lang := StringVal(s.config().Language)
+	greeting, ok := greetings[lang]
+	if !ok {
+		lang = "english"
+		greeting = greetings[lang]
 	}
+	return greeting, lang
 }
 
 func (s *server) disableHealth() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		s.cfg.mu.Lock()
-		defer s.cfg.mu.Unlock()
-
-		s.cfg.EnableChecks = BoolPtr(false)
+		s.update(sourceHTTP, triggerHTTP, requestCaller(r), func(c *serverConfig) error {
+			c.EnableChecks = BoolPtr(false)
+			return nil
+		})
 		fmt.Fprintln(w, "Health endpoint disabled.")
 	}
 }
 
 func (s *server) enableHealth() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		s.cfg.mu.Lock()
-		defer s.cfg.mu.Unlock()
-
-		s.cfg.EnableChecks = BoolPtr(true)
+		s.update(sourceHTTP, triggerHTTP, requestCaller(r), func(c *serverConfig) error {
+			c.EnableChecks = BoolPtr(true)
+			return nil
+		})
 		fmt.Fprintln(w, "Health endpoint enabled.")
 	}
 }
 
-func (s *server) runTTL(ctx context.Context, interval time.Duration) {
-	ticker := time.NewTicker(interval)
+// failHealth reports the TTL check as critical right away instead of waiting
+// for it to expire. The health evaluator reports critical while draining.
+func (s *server) failHealth() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	httpClient := http.Client{
-		Timeout: time.Second * 10,
+	if res, err := s.updateTTL(ctx); err != nil {
+		logger("ttl").Error("failed to update check", "check_id", StringVal(s.config().TTLID), "error", err)
+	} else {
+		logger("ttl").Info("updated check", "check_id", StringVal(s.config().TTLID), "status", res.Status, "output", res.Output)
 	}
+}
+
+// checkDefinitions returns the TTL check registered with the service, which
+// runTTL keeps updated.
+func (s *server) checkDefinitions(cfg *serverConfig, svc agentService) []agentCheck {
+	return []agentCheck{{
+		CheckID: StringVal(cfg.TTLID),
+		Name:    fmt.Sprintf("%s TTL", StringVal(cfg.CheckTTL)),
+		TTL:     StringVal(cfg.CheckTTL),
+	}}
+}
+
+// connectDefinition returns nil, as hello-ttl does not serve Connect.
+func (s *server) connectDefinition() *agentServiceConnect {
+	return nil
+}
+
+// runTTL reports the status from the health evaluator to the TTL check every
+// interval, and whenever the health may have changed. Updates are only logged
+// when the status or its output changes.
+func (s *server) runTTL(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	changed := s.checks.changed.subscribe()
 
 	go func() {
+		defer ticker.Stop()
+
+		var last healthResult
 		for {
 			select {
 			case <-ctx.Done():
-				ticker.Stop()
 				return
-			default:
-				<-ticker.C
+			case <-ticker.C:
+			case <-changed:
+			}
 
-				var enableChecks bool
-				s.cfg.mu.RLock()
-				{
-					enableChecks = BoolVal(s.cfg.EnableChecks)
-				}
-				s.cfg.mu.RUnlock()
-
-				if enableChecks {
-					target := StringVal(s.cfg.ConsulAddr) + StringVal(s.cfg.TTLEndpoint) + StringVal(s.cfg.TTLID)
-					req, err := http.NewRequest("PUT", target, nil)
-					if err != nil {
-						log.Printf("[ERR] ttl: failed to create update request: %v", err)
-						continue
-					}
-					resp, err := httpClient.Do(req)
-					if err != nil {
-						log.Printf("[ERR] ttl: failed to do update request: %v", err)
-						continue
-					}
-					b, err := ioutil.ReadAll(resp.Body)
-					if err != nil {
-						log.Printf("[ERR] ttl: failed to read response body: %v", err)
-						continue
-					}
-					resp.Body.Close()
-
-					if resp.StatusCode != http.StatusOK {
-						log.Printf("[ERR] ttl: failed to update check status. " +
-							"code: %d, resp: %s", resp.StatusCode, b)
-						continue
-					}
-
-					log.Printf("[INFO] ttl: Updated check '%s' to passing", StringVal(s.cfg.TTLID))
+			reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			res, err := s.updateTTL(reqCtx)
+			cancel()
+			if err != nil {
+				// Denials are logged once and counted by consulDo
+				if !errors.Is(err, errACLDenied) {
+					logger("ttl").Error("failed to update check", "check_id", StringVal(s.config().TTLID), "error", err)
 				}
+				continue
+			}
+
+			if res != last {
+				logger("ttl").Info("updated check", "check_id", StringVal(s.config().TTLID), "status", res.Status, "output", res.Output)
+				last = res
 			}
 		}
 	}()
 }
 
+// updateTTL sets the TTL check to the status from the health evaluator.
+// See: https://www.consul.io/api/agent/check.html#ttl-check-update
+func (s *server) updateTTL(ctx context.Context) (healthResult, error) {
+	res := s.health.evaluate()
+	body, err := json.Marshal(checkUpdate{res.Status, res.Output})
+	if err != nil {
+		return res, fmt.Errorf("failed to encode check update: %v", err)
+	}
+
+	cfg := s.config()
+	resp, err := s.consulPut(ctx, StringVal(cfg.TTLEndpoint)+url.PathEscape(StringVal(cfg.TTLID)), body)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("failed to update check status. code: %d, resp: %s", resp.StatusCode, resp.Body)
+	}
+	ttlUpdates.WithLabelValues(StringVal(cfg.TTLID), result(err)).Inc()
+	return res, err
+}
+
 // watchKV watches a Key/Value pair in Consul for changes and sets the value internally
 // See below for implementation details:
 // https://www.consul.io/api/features/blocking.html#implementation-details
 func (s *server) watchKV(ctx context.Context, key string, limit rate.Limit, burst int) {
 	var index uint64 = 1
 	var lastIndex uint64
-	var consulAddr, kvPath, svcName string
 
 	limiter := rate.NewLimiter(limit, burst)
 
 	for {
-		s.cfg.mu.RLock()
-		{
-			consulAddr = StringVal(s.cfg.ConsulAddr)
-			kvPath = StringVal(s.cfg.KVPath)
-			svcName = StringVal(s.cfg.ServiceName)
-		}
-		s.cfg.mu.RUnlock()
-
 		// Wait until limiter allows request to happen
-		if err := limiter.Wait(context.Background()); err != nil {
-			log.Printf("[ERR] watch '%s': failed to wait for limiter", key)
+		if err := limiter.Wait(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger("watch").Error("failed to wait for limiter", "key", key)
 			continue
 		}
 
 		// Make blocking query to watch key
-		target := fmt.Sprintf("%s%s%s?index=%d", consulAddr, kvPath, key, index)
-		resp, err := http.Get(target)
+		cfg := s.config()
+		resp, err := s.consulGet(ctx, StringVal(cfg.KVPath)+key, index)
+		if ctx.Err() != nil {
+			return
+		}
+		kvWatchIterations.WithLabelValues(key).Inc()
 		if err != nil {
-			log.Printf("[ERR] watch '%s': failed to get '%s': %v", key, target, err)
+			kvWatchErrors.WithLabelValues(key).Inc()
+			// Denials are logged once and counted by consulDo
+			if !errors.Is(err, errACLDenied) {
+				logger("watch").Error("watch failed", "key", key, "error", err)
+			}
 			continue
 		}
-		defer resp.Body.Close()
 
-		// Parse the raft index for this key (X-Consul-Index)
-		header := resp.Header
-		indexStr := header.Get("X-Consul-Index")
-		if indexStr != "" {
-			index, err = strconv.ParseUint(indexStr, 10, 64)
-			if err != nil {
-				log.Printf("[ERR] watch '%s': failed to parse X-Consul-Index: %v", key, err)
-				continue
-			}
+		// Raft index for this key (X-Consul-Index)
+		if resp.Index != 0 {
+			index = resp.Index
 		}
 		// Reset if it goes backwards or is 0
 		// See: https://www.consul.io/api/features/blocking.html#implementation-details
 		if index < lastIndex || index == 0 {
+			logger("watch").Debug("index went backwards, resetting", "key", key, "index", lastIndex, "new_index", index)
 			index = 1
 			lastIndex = 1
 
 			// TODO: Continuing implies we don't trust the data on the server
 			continue
 		}
+		if index != lastIndex {
+			logger("watch").Debug("index changed", "key", key, "index", lastIndex, "new_index", index)
+		}
 		lastIndex = index
+		if _, synced := s.synced.Swap(key, time.Now()); !synced {
+			// The first sync may make the service ready
+			s.healthChanged()
+		}
 
 		data := make([]keyResponse, 0)
-		json.NewDecoder(resp.Body).Decode(&data)
-		resp.Body.Close()
+		json.Unmarshal(resp.Body, &data)
 
 		// Key might not exist yet
 		if len(data) == 0 {
-			log.Printf("[WARN] watch '%s': empty response, key does not exist", key)
+			logger("watch").Warn("empty response, key does not exist", "key", key)
 			continue
 		}
 
 		// We are not recursing on a key-prefix so these arrays will only return one value
 		decoded, err := base64.StdEncoding.DecodeString(data[0].Value)
 		if err != nil {
-			log.Printf("[ERR] watch '%s': failed to decode value: '%s'", key, data[0].Value)
+			kvWatchErrors.WithLabelValues(key).Inc()
+			logger("watch").Error("failed to decode value", "key", key, "value", data[0].Value)
 			continue
 		}
 		strVal := string(decoded)
 
-		err = nil
-		switch key {
-		case "language":
-			s.setLanguage(strVal)
-		case svcName + "enable_checks":
-			err = s.setEnableChecks(strVal)
-		}
-		if err != nil {
-			log.Printf("[ERR] watch '%s': %v", key, err)
+		if err := s.setKV(key, strVal); err != nil {
+			if err == errUnknownKey {
+				logger("watch").Warn("ignoring value", "key", key, "error", err)
+			} else {
+				kvWatchErrors.WithLabelValues(key).Inc()
+				logger("watch").Error("failed to set value", "key", key, "error", err)
+			}
 			continue
 		}
 
-		log.Printf("[INFO] watch '%s': updated to %s", key, strVal)
-	}
-}
-
-func (s *server) setLanguage(lang string) {
-	s.cfg.mu.Lock()
-	defer s.cfg.mu.Unlock()
-
-	s.cfg.Language = StringPtr(lang)
-}
-
-func (s *server) setEnableChecks(val string) error {
-	s.cfg.mu.Lock()
-	defer s.cfg.mu.Unlock()
-
-	parsed, err := strconv.ParseBool(val)
-	if err != nil {
-		return fmt.Errorf("failed to parse enable_checks bool '%s': %v", val, err)
+		kvLastUpdate.WithLabelValues(key).SetToCurrentTime()
+		logger("watch").Info("updated", "key", key, "value", strVal)
 	}
-	s.cfg.EnableChecks = BoolPtr(parsed)
-	return nil
 }
 
 type keyResponse struct {
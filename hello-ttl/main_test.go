@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// Only log with -v
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a server reading cfg from a JSON config file in a
+// temporary directory.
+func newTestServer(t *testing.T, cfg map[string]interface{}) *server {
+	t.Helper()
+
+	body, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgFile := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(cfgFile, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return newServer(cfgFile, &serverConfig{})
+}
+
+// serve sends a request to the server's router and returns the response.
+func serve(s *server, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+// TestWatchKVStopsOnCancel checks that watchKV returns once its context is
+// cancelled, whether it is blocked on Consul or waiting for the limiter.
+func TestWatchKVStopsOnCancel(t *testing.T) {
+	tests := []struct {
+		name  string
+		block bool
+	}{
+		{"blocking query", true},
+		{"limiter", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan struct{}, 10)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests <- struct{}{}
+				if tt.block {
+					<-r.Context().Done()
+					return
+				}
+				http.Error(w, "unavailable", http.StatusInternalServerError)
+			}))
+			defer ts.Close()
+			s := newTestServer(t, map[string]interface{}{"consul_addr": ts.URL})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.watchKV(ctx, "language", rate.Every(time.Hour), 1)
+			}()
+
+			select {
+			case <-requests:
+			case <-time.After(5 * time.Second):
+				t.Fatal("watchKV did not query Consul")
+			}
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("watchKV did not return after its context was cancelled")
+			}
+		})
+	}
+}
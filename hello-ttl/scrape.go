@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Service meta advertising the metrics endpoint to Prometheus, which finds it
+// through consul_sd_configs as __meta_consul_service_metadata_<key>.
+const (
+	metaMetricsPort = "metrics_port"
+	metaMetricsPath = "metrics_path"
+)
+
+// metricsMeta returns the service meta advertising the metrics listener on
+// addr at path, or nil if addr has no port.
+func metricsMeta(addr, path string) map[string]string {
+	port, err := listenPort(addr)
+	if err != nil {
+		return nil
+	}
+	return map[string]string{
+		metaMetricsPort: strconv.Itoa(port),
+		metaMetricsPath: path,
+	}
+}
+
+// promConfig is the part of a Prometheus config file holding scrape configs.
+// See: https://prometheus.io/docs/prometheus/latest/configuration/configuration/
+type promConfig struct {
+	ScrapeConfigs []scrapeConfig `yaml:"scrape_configs"`
+}
+
+type scrapeConfig struct {
+	JobName        string          `yaml:"job_name"`
+	MetricsPath    string          `yaml:"metrics_path"`
+	ConsulSD       []consulSD      `yaml:"consul_sd_configs"`
+	RelabelConfigs []relabelConfig `yaml:"relabel_configs"`
+}
+
+type consulSD struct {
+	Server   string   `yaml:"server"`
+	Scheme   string   `yaml:"scheme"`
+	Services []string `yaml:"services"`
+}
+
+type relabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator,omitempty"`
+	Regex        string   `yaml:"regex,omitempty"`
+	Replacement  string   `yaml:"replacement,omitempty"`
+	TargetLabel  string   `yaml:"target_label,omitempty"`
+	Action       string   `yaml:"action,omitempty"`
+}
+
+// newScrapeConfig returns a Prometheus config that discovers the service
+// registered with cfg through its Consul agent, and scrapes the metrics
+// endpoint advertised in the service meta. metricsPath is used for instances
+// that do not advertise a path.
+func newScrapeConfig(cfg *serverConfig, metricsPath string) (*promConfig, error) {
+	u, err := url.Parse(StringVal(cfg.ConsulAddr))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("consul_addr '%s' must be an http(s) URL for Prometheus", StringVal(cfg.ConsulAddr))
+	}
+
+	meta := func(key string) string { return "__meta_consul_service_metadata_" + key }
+	name := StringVal(cfg.RegisterName)
+	return &promConfig{ScrapeConfigs: []scrapeConfig{{
+		JobName:     name,
+		MetricsPath: metricsPath,
+		ConsulSD: []consulSD{{
+			Server:   u.Host,
+			Scheme:   u.Scheme,
+			Services: []string{name},
+		}},
+		RelabelConfigs: []relabelConfig{
+			// Only scrape instances that advertise their metrics port
+			{SourceLabels: []string{meta(metaMetricsPort)}, Regex: ".+", Action: "keep"},
+			// Scrape the node address, or the service address when it is set
+			{SourceLabels: []string{"__meta_consul_address", meta(metaMetricsPort)}, Separator: ":", TargetLabel: "__address__"},
+			{SourceLabels: []string{"__meta_consul_service_address", meta(metaMetricsPort)}, Regex: "(.+);(.+)", Replacement: "$1:$2", TargetLabel: "__address__"},
+			{SourceLabels: []string{meta(metaMetricsPath)}, Regex: "(.+)", TargetLabel: "__metrics_path__"},
+			{SourceLabels: []string{"__meta_consul_service_id"}, TargetLabel: "instance"},
+		},
+	}}}, nil
+}
+
+// writeScrapeConfig writes the example scrape config for the config built
+// from cfgFile and flags to w.
+func writeScrapeConfig(w io.Writer, cfgFile string, flags *serverConfig, metricsPath string) error {
+	layers, err := newConfigLayers(cfgFile, flags)
+	if err != nil {
+		return err
+	}
+	cfg, err := layers.build()
+	if err != nil {
+		return err
+	}
+	pc, err := newScrapeConfig(cfg, metricsPath)
+	if err != nil {
+		return err
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(pc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// shutdownTimeout bounds how long in-flight requests may take to finish
+	// once the servers stop accepting new ones.
+	shutdownTimeout = 15 * time.Second
+
+	// deregisterTimeout bounds how long shutdown waits for the service to be
+	// deregistered.
+	deregisterTimeout = 10 * time.Second
+)
+
+// lifecycle tracks the servers to stop on shutdown and whether the service is
+// draining.
+type lifecycle struct {
+	draining atomic.Bool
+
+	mu       sync.Mutex
+	stoppers []stopper
+
+	// done is closed once shutdown is complete.
+	done chan struct{}
+}
+
+// stopper gracefully stops a server, waiting for in-flight requests until ctx
+// is done.
+type stopper struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{done: make(chan struct{})}
+}
+
+// onStop registers a server to stop on shutdown.
+func (l *lifecycle) onStop(name string, stop func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stoppers = append(l.stoppers, stopper{name: name, stop: stop})
+}
+
+// stopAll stops every registered server concurrently.
+func (l *lifecycle) stopAll(ctx context.Context) {
+	l.mu.Lock()
+	stoppers := l.stoppers
+	l.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, st := range stoppers {
+		wg.Add(1)
+		go func(st stopper) {
+			defer wg.Done()
+			if err := st.stop(ctx); err != nil {
+				logger("shutdown").Error("failed to stop server gracefully", "server", st.name, "error", err)
+			}
+		}(st)
+	}
+	wg.Wait()
+}
+
+// captureShutdown drains the service on SIGINT or SIGTERM. Health checks are
+// failed first so that Consul and DNS stop routing to the service, and the
+// servers are only stopped once drain_period has passed, letting in-flight
+// requests finish. Finally ctx is cancelled, which deregisters the service.
+// A second signal skips the rest of the drain period.
+func (s *server) captureShutdown(cancel context.CancelFunc, deregistered <-chan struct{}) {
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	s.shutdown(<-sigCh, sigCh, cancel, deregistered)
+}
+
+// shutdown drains the service after sig was captured, see captureShutdown.
+// A signal on sigCh skips the rest of the drain period.
+func (s *server) shutdown(sig os.Signal, sigCh <-chan os.Signal, cancel context.CancelFunc, deregistered <-chan struct{}) {
+	drain, _ := time.ParseDuration(StringVal(s.config().DrainPeriod))
+	logger("shutdown").Info("captured signal, draining before shutting down", "signal", sig.String(), "drain_period", drain)
+
+	s.life.draining.Store(true)
+	s.healthChanged()
+	s.failHealth()
+
+	select {
+	case <-time.After(drain):
+	case sig := <-sigCh:
+		logger("shutdown").Warn("captured signal, skipping the rest of the drain period", "signal", sig.String())
+	}
+
+	logger("shutdown").Info("stopping servers")
+	ctx, stop := context.WithTimeout(context.Background(), shutdownTimeout)
+	s.life.stopAll(ctx)
+	stop()
+
+	cancel()
+	select {
+	case <-deregistered:
+	case <-time.After(deregisterTimeout):
+		logger("registration").Warn("timed out waiting for deregistration")
+	}
+
+	logger("shutdown").Info("complete")
+	close(s.life.done)
+}
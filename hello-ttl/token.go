@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consulToken is the ACL token sent with every request to Consul. It is
+// either fixed or read from a file, which is read again whenever it changes
+// so that rotated tokens are picked up without a restart.
+// See: https://www.consul.io/docs/commands#environment-variables
+type consulToken struct {
+	token string
+	file  string
+
+	mu      sync.Mutex
+	modTime time.Time
+	cached  string
+}
+
+// newConsulToken picks the token the same way the Consul CLI does: a token
+// given on the command line, then a token file given on the command line,
+// then CONSUL_HTTP_TOKEN, then CONSUL_HTTP_TOKEN_FILE.
+func newConsulToken(token, file string) *consulToken {
+	switch {
+	case token != "":
+		return &consulToken{token: token}
+	case file != "":
+		return &consulToken{file: file}
+	case os.Getenv("CONSUL_HTTP_TOKEN") != "":
+		return &consulToken{token: os.Getenv("CONSUL_HTTP_TOKEN")}
+	default:
+		return &consulToken{file: os.Getenv("CONSUL_HTTP_TOKEN_FILE")}
+	}
+}
+
+// get returns the current token, or "" if none is configured. If the token
+// file cannot be read the last token read from it is kept.
+func (t *consulToken) get() string {
+	if t == nil {
+		return ""
+	}
+	if t.file == "" {
+		return t.token
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info, err := os.Stat(t.file)
+	if err != nil {
+		logger("consul").Error("failed to stat token file, keeping current token", "file", t.file, "error", err)
+		return t.cached
+	}
+	if info.ModTime().Equal(t.modTime) {
+		return t.cached
+	}
+
+	body, err := ioutil.ReadFile(t.file)
+	if err != nil {
+		logger("consul").Error("failed to read token file, keeping current token", "file", t.file, "error", err)
+		return t.cached
+	}
+	if !t.modTime.IsZero() {
+		logger("consul").Info("token file changed, using the new token", "file", t.file)
+	}
+	t.cached = strings.TrimSpace(string(body))
+	t.modTime = info.ModTime()
+	return t.cached
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCheckAgent records the TTL check updates sent to a Consul agent, and
+// answers them with code.
+type fakeCheckAgent struct {
+	code    int
+	updates chan healthResult
+}
+
+func newFakeCheckAgent(t *testing.T, code int) (*fakeCheckAgent, *httptest.Server) {
+	a := fakeCheckAgent{code: code, updates: make(chan healthResult, 100)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var update struct {
+			Status string
+			Output string
+		}
+		if r.Method != "PUT" || r.URL.Path != "/v1/agent/check/update/hello-ttl" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.updates <- healthResult{update.Status, update.Output}
+		w.WriteHeader(a.code)
+	}))
+	t.Cleanup(ts.Close)
+	return &a, ts
+}
+
+// markSynced marks every watched key as synced from Consul, so that the
+// service is ready.
+func markSynced(s *server) {
+	for _, key := range SliceVal(s.config().ToWatch) {
+		s.synced.Store(key, time.Now())
+	}
+}
+
+// next waits for the next check update.
+func (a *fakeCheckAgent) next(t *testing.T) healthResult {
+	t.Helper()
+
+	select {
+	case res := <-a.updates:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("the check was not updated")
+		return healthResult{}
+	}
+}
+
+func TestUpdateTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      map[string]interface{}
+		unsynced bool
+		setup    func(s *server)
+		status   string
+		output   string
+	}{
+		{
+			name:   "healthy",
+			status: statusPassing,
+		},
+		{
+			name:     "not synced",
+			unsynced: true,
+			status:   statusCritical,
+			output:   "Waiting for the first sync of 'hello-ttl/enable_checks' from Consul",
+		},
+		{
+			name:   "checks disabled",
+			cfg:    map[string]interface{}{"enable_checks": false},
+			status: statusCritical,
+			output: "Checks are disabled by enable_checks, set from file",
+		},
+		{
+			name:   "draining",
+			setup:  func(s *server) { s.life.draining.Store(true) },
+			status: statusCritical,
+			output: "Service is draining before shutdown",
+		},
+		{
+			name: "failing check",
+			setup: func(s *server) {
+				s.checks.register(healthCheck{name: "disk", interval: time.Hour, timeout: time.Second})
+				s.checks.record("disk", healthResult{statusWarning, "Disk is 90% full"})
+			},
+			status: statusWarning,
+			output: "disk: Disk is 90% full",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent, ts := newFakeCheckAgent(t, http.StatusOK)
+			cfg := map[string]interface{}{"consul_addr": ts.URL}
+			for k, v := range tt.cfg {
+				cfg[k] = v
+			}
+			s := newTestServer(t, cfg)
+			if !tt.unsynced {
+				markSynced(s)
+			}
+			if tt.setup != nil {
+				tt.setup(s)
+			}
+
+			want := healthResult{tt.status, tt.output}
+			if want.Output == "" {
+				want.Output = fmt.Sprintf("All %d checks passing", len(s.checks.list()))
+			}
+			res, err := s.updateTTL(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != want {
+				t.Errorf("got %+v, want %+v", res, want)
+			}
+			if got := agent.next(t); got != want {
+				t.Errorf("check updated to %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestUpdateTTLAgentError(t *testing.T) {
+	_, ts := newFakeCheckAgent(t, http.StatusInternalServerError)
+	s := newTestServer(t, map[string]interface{}{"consul_addr": ts.URL})
+
+	_, err := s.updateTTL(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "code: 500") {
+		t.Errorf("got error %v, want one for code 500", err)
+	}
+}
+
+// TestRunTTL checks that config changes are reported right away rather than
+// on the next interval.
+func TestRunTTL(t *testing.T) {
+	agent, ts := newFakeCheckAgent(t, http.StatusOK)
+	s := newTestServer(t, map[string]interface{}{"consul_addr": ts.URL})
+	markSynced(s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.runTTL(ctx, time.Hour)
+
+	for _, step := range []struct {
+		path   string
+		status string
+	}{
+		{"/health/fail", statusCritical},
+		{"/health/pass", statusPassing},
+	} {
+		if w := serve(s, "PUT", step.path, ""); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", step.path, w.Code)
+		}
+		if got := agent.next(t); got.Status != step.status {
+			t.Errorf("after PUT %s: check updated to %+v, want %s", step.path, got, step.status)
+		}
+	}
+}
+
+// TestFailHealthWhileDraining checks that the check turns critical as soon as
+// the service starts draining, without waiting for runTTL.
+func TestFailHealthWhileDraining(t *testing.T) {
+	agent, ts := newFakeCheckAgent(t, http.StatusOK)
+	s := newTestServer(t, map[string]interface{}{"consul_addr": ts.URL})
+
+	s.life.draining.Store(true)
+	s.failHealth()
+
+	want := healthResult{statusCritical, "Service is draining before shutdown"}
+	select {
+	case got := <-agent.updates:
+		if got != want {
+			t.Errorf("check updated to %+v, want %+v", got, want)
+		}
+	default:
+		t.Error("failHealth returned before updating the check")
+	}
+}